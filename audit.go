@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+type auditRecord struct {
+	Time      string `json:"time"`
+	RequestID string `json:"request_id"`
+	ClientIP  string `json:"client_ip"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+}
+
+// openAuditLog opens path for appending only, creating it if needed
+func openAuditLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+// audit writes a JSON line for every request to its own logger, whatever
+// the access log is doing. The file is written unbuffered so a record is on
+// its way to disk before the response completes
+func audit(auditLog *log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if auditLog == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			panicked := true
+			defer func() {
+				record, _ := json.Marshal(auditRecord{
+					Time:      time.Now().UTC().Format(time.RFC3339Nano),
+					RequestID: requestIDFrom(r.Context()),
+					ClientIP:  clientIP(r),
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					Status:    rw.finalStatus(panicked),
+				})
+				auditLog.Println(string(record))
+			}()
+			next.ServeHTTP(rw, r)
+			panicked = false
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "strings"
+
+// version is set at build time with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+const bannerArt = `
+  _          _ _                            _     _
+ | |__   ___| | | _____      _____  _ __| | __| |
+ | '_ \ / _ \ | |/ _ \ \ /\ / / _ \| '__| |/ _' |
+ | | | |  __/ | | (_) \ V  V / (_) | |  | | (_| |
+ |_| |_|\___|_|_|\___/ \_/\_/ \___/|_|  |_|\__,_|
+`
+
+// banner is printed at startup with -banner, as one log entry so it stays
+// together when log lines from other goroutines interleave
+func banner() string {
+	return strings.TrimRight(bannerArt, "\n") + "\n  helloworld " + version + "\n"
+}
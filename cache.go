@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cacheMaxAges is the -cache-max-age flag, seconds keyed on file extension
+// given as ".jpg=86400,.css=3600". Setting it replaces the defaults
+type cacheMaxAges map[string]int
+
+func (c cacheMaxAges) String() string {
+	var pairs []string
+	for ext, age := range c {
+		pairs = append(pairs, ext+"="+strconv.Itoa(age))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (c cacheMaxAges) Set(list string) error {
+	for ext := range c {
+		delete(c, ext)
+	}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		eq := strings.Index(pair, "=")
+		if eq < 0 {
+			return fmt.Errorf("%q must look like .ext=seconds", pair)
+		}
+		ext := strings.ToLower(strings.TrimSpace(pair[:eq]))
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("%q is not a file extension, it needs a leading dot", ext)
+		}
+		age, err := strconv.Atoi(strings.TrimSpace(pair[eq+1:]))
+		if err != nil || age < 0 {
+			return fmt.Errorf("max-age for %s must be a whole number of seconds", ext)
+		}
+		c[ext] = age
+	}
+	return nil
+}
+
+// cacheControl sets Cache-Control on static files whose extension has a
+// max-age. Anything else is left to the browser
+func cacheControl(ages cacheMaxAges) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if age, ok := ages[strings.ToLower(path.Ext(r.URL.Path))]; ok {
+				w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(age))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressionLevel is the -compression-level flag, a gzip level from 1 to 9
+// or best-speed, default or best-compression
+type compressionLevel int
+
+var compressionNames = map[string]compressionLevel{
+	"best-speed":       gzip.BestSpeed,
+	"default":          6,
+	"best-compression": gzip.BestCompression,
+}
+
+func (l *compressionLevel) String() string {
+	return strconv.Itoa(int(*l))
+}
+
+func (l *compressionLevel) Set(value string) error {
+	if named, ok := compressionNames[strings.ToLower(value)]; ok {
+		*l = named
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < gzip.BestSpeed || n > gzip.BestCompression {
+		return fmt.Errorf("must be 1 to 9, best-speed, default or best-compression")
+	}
+	*l = compressionLevel(n)
+	return nil
+}
+
+// compressible is true for content types worth gzipping, images and the
+// like are already compressed
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"text/", "application/json", "application/javascript", "image/svg+xml"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedEncodings reads an Accept-Encoding header for whether gzip and
+// identity (no encoding) are acceptable, honouring q=0 and *. No header at
+// all gets no compression
+func acceptedEncodings(header string) (gzipOK, identityOK bool) {
+	if strings.TrimSpace(header) == "" {
+		return false, true
+	}
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = v
+				}
+			}
+		}
+		q[coding] = weight
+	}
+
+	accepted := func(coding string, byDefault bool) bool {
+		if weight, ok := q[coding]; ok {
+			return weight > 0
+		}
+		if weight, ok := q["*"]; ok {
+			return weight > 0
+		}
+		return byDefault
+	}
+	// identity is acceptable unless it's ruled out, gzip only if asked for
+	return accepted("gzip", false), accepted("identity", true)
+}
+
+// gzipResponseWriter decides whether to compress once the status and
+// content type are known, at the first WriteHeader or Write. It only starts
+// the gzip stream when there is a body to put in it, so a response that
+// never writes one keeps its headers as they are
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	pool        *sync.Pool
+	gz          *gzip.Writer
+	code        int
+	wroteHeader bool
+	// the status has gone to the client, WriteHeader is only held back
+	// while we wait to see whether a body follows
+	sent bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	g.code = code
+
+	h := g.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		g.sent = true
+		g.ResponseWriter.WriteHeader(code)
+	}
+}
+
+// start sends the held back status with gzip headers and starts the stream
+func (g *gzipResponseWriter) start() {
+	if g.sent {
+		return
+	}
+	g.sent = true
+	h := g.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	g.gz = g.pool.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+	g.ResponseWriter.WriteHeader(g.code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.sent {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		g.start()
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// ReadFrom only passes through uncompressed responses, the rest has to go
+// through gzip
+func (g *gzipResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !g.sent || g.gz != nil {
+		return io.Copy(writerOnly{g}, src)
+	}
+	return readFrom(g.ResponseWriter, src)
+}
+
+// Flush sends what has been compressed so far, for streamed responses
+func (g *gzipResponseWriter) Flush() {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	g.start()
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", g.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// close finishes the gzip stream, if there is one, and recycles the writer.
+// A status still held back had no body, it goes out uncompressed
+func (g *gzipResponseWriter) close() {
+	if g.wroteHeader && !g.sent {
+		g.sent = true
+		g.ResponseWriter.WriteHeader(g.code)
+	}
+	if g.gz == nil {
+		return
+	}
+	g.gz.Close()
+	g.gz.Reset(ioutil.Discard)
+	g.pool.Put(g.gz)
+	g.gz = nil
+}
+
+// notAcceptableWriter holds back the 406 for a client that accepts no
+// encoding at all until the handler shows there is a body to encode. A 204
+// or 304 goes out as it is, there is nothing in it to refuse
+type notAcceptableWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+	rejected    bool
+}
+
+func (n *notAcceptableWriter) WriteHeader(code int) {
+	if n.wroteHeader {
+		return
+	}
+	n.wroteHeader = true
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		n.ResponseWriter.WriteHeader(code)
+		return
+	}
+	n.rejected = true
+	n.Header().Del("Content-Length")
+	writeJSONError(n.ResponseWriter, n.r, http.StatusNotAcceptable, "no acceptable content encoding, gzip and identity are available")
+}
+
+func (n *notAcceptableWriter) Write(b []byte) (int, error) {
+	if !n.wroteHeader {
+		n.WriteHeader(http.StatusOK)
+	}
+	if n.rejected {
+		return len(b), nil
+	}
+	return n.ResponseWriter.Write(b)
+}
+
+func (n *notAcceptableWriter) Flush() {
+	if f, ok := n.ResponseWriter.(http.Flusher); ok && n.wroteHeader {
+		f.Flush()
+	}
+}
+
+func (n *notAcceptableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := n.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", n.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// compress gzips text responses for clients that accept it. Range requests
+// are left alone, their byte ranges are of the uncompressed file, and so is
+// HEAD, which has no body to compress
+//
+// A client that accepts neither gzip nor identity gets a 406, except on the
+// paths in skip and for HEAD, which have nothing to encode. Other methods
+// get it straight away, before the handler can change anything, while GET
+// only gets it once there turns out to be a body
+func compress(enabled bool, level compressionLevel, skip map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		pool := &sync.Pool{New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(ioutil.Discard, int(level))
+			return gz
+		}}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			gzipOK, identityOK := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+			if !gzipOK && !identityOK && !skip[r.URL.Path] && r.Method != http.MethodHead {
+				if r.Method != http.MethodGet {
+					writeJSONError(w, r, http.StatusNotAcceptable, "no acceptable content encoding, gzip and identity are available")
+					return
+				}
+				next.ServeHTTP(&notAcceptableWriter{ResponseWriter: w, r: r}, r)
+				return
+			}
+			if !gzipOK || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			gw := &gzipResponseWriter{ResponseWriter: w, pool: pool}
+			defer gw.close()
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
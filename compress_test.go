@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompressLeavesBodylessResponses(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"no content": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		},
+		"not modified": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotModified)
+		},
+		"header only": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusOK)
+		},
+		"empty write": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(nil)
+		},
+	}
+	for name, h := range handlers {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		compress(true, 6, nil)(h).ServeHTTP(w, req)
+		if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding is %q, want none", name, got)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: got a %d byte body, want none", name, w.Body.Len())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	compress(true, 6, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	})).ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("a text body: Content-Encoding is %q, want gzip", got)
+	}
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	tests := []struct {
+		header           string
+		gzipOK, identity bool
+	}{
+		{"", false, true},
+		{"  ", false, true},
+		{"gzip", true, true},
+		{"GZIP", true, true},
+		{"gzip;q=0", false, true},
+		{"gzip; q=0.5", true, true},
+		{"*", true, true},
+		{"*;q=0", false, false},
+		{"gzip, *;q=0", true, false},
+		{"identity", false, true},
+		{"identity;q=0", false, false},
+		{"identity;q=0, *;q=0", false, false},
+		{"br, identity;q=0", false, false},
+		{"gzip, identity;q=0", true, false},
+	}
+	for _, tt := range tests {
+		gzipOK, identityOK := acceptedEncodings(tt.header)
+		if gzipOK != tt.gzipOK || identityOK != tt.identity {
+			t.Errorf("%q: gzip %v identity %v, want %v and %v", tt.header, gzipOK, identityOK, tt.gzipOK, tt.identity)
+		}
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	s := startTestServer(t, "-gzip")
+	defer s.Close()
+
+	tests := []struct {
+		method   string
+		path     string
+		header   string
+		status   int
+		encoding string
+	}{
+		{http.MethodGet, "/uptime", "gzip", http.StatusOK, "gzip"},
+		{http.MethodGet, "/uptime", "*", http.StatusOK, "gzip"},
+		{http.MethodGet, "/uptime", "gzip;q=0", http.StatusOK, ""},
+		{http.MethodGet, "/uptime", "identity", http.StatusOK, ""},
+		{http.MethodGet, "/uptime", "*;q=0", http.StatusNotAcceptable, ""},
+		{http.MethodGet, "/uptime", "identity;q=0, *;q=0", http.StatusNotAcceptable, ""},
+		{http.MethodPost, "/stack", "identity;q=0, *;q=0", http.StatusNotAcceptable, ""},
+		{http.MethodHead, "/uptime", "identity;q=0, *;q=0", http.StatusOK, ""},
+		{http.MethodGet, "/livez", "identity;q=0, *;q=0", http.StatusNoContent, ""},
+		{http.MethodGet, "/readyz", "identity;q=0, *;q=0", http.StatusOK, ""},
+		{http.MethodHead, "/readyz", "identity;q=0, *;q=0", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		res, _ := s.do(t, tt.method, tt.path, "Accept-Encoding", tt.header)
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s with %q: got %d, want %d", tt.method, tt.path, tt.header, res.StatusCode, tt.status)
+		}
+		if got := res.Header.Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s %s with %q: Content-Encoding is %q, want %q", tt.method, tt.path, tt.header, got, tt.encoding)
+		}
+	}
+
+	// a 304 has no body to refuse either
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "identity;q=0, *;q=0")
+	compress(true, 6, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})).ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("a 304: got %d, want it passed through", w.Code)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every flag can be set with an environment variable named after it with
+// this in front, see envName
+const envPrefix = "APP_"
+
+var (
+	configPath string
+
+	// flags given on the command line, these always beat the config file
+	cliFlags = map[string]bool{}
+	// flags set from the environment, these beat the config file too
+	envFlags = map[string]bool{}
+	// flags whose value came from the config file. A reload adds to it
+	// while /debug/config may be reading it, so that's done under configMu
+	configFlags = map[string]bool{}
+	configMu    sync.RWMutex
+	// what the config file said when it was last read
+	loadedConfig map[string][]string
+)
+
+// settings that can change on SIGHUP without a restart, and how to apply
+// them once the flag has its new value
+var reloadable = map[string]func(logger *log.Logger){
+	"redis": func(logger *log.Logger) {
+		if noRedis {
+			logger.Println("Ignoring the new Redis address, running with -no-redis")
+			return
+		}
+		client := newRedisClient(currentRedisAddr())
+		setRedis(client)
+		if testRedisConnection(client) {
+			logger.Printf("Reconnected to Redis on %s\n", client.Options().Addr)
+		} else {
+			logger.Printf("Redis on %s is not reachable\n", client.Options().Addr)
+		}
+	},
+}
+
+// readConfig reads a JSON object of names of flags in fs to values. A list
+// sets a repeatable flag once for each value
+func readConfig(fs *flag.FlagSet, path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// numbers stay as written, as float64 1000000 would print as 1e+06
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("could not parse %s: more than one JSON object", path)
+	}
+
+	config := make(map[string][]string, len(raw))
+	for name, value := range raw {
+		if name == "config" || fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown setting %q in %s", name, path)
+		}
+		if list, ok := value.([]interface{}); ok {
+			for _, v := range list {
+				config[name] = append(config[name], fmt.Sprint(v))
+			}
+			continue
+		}
+		config[name] = []string{fmt.Sprint(value)}
+	}
+	return config, nil
+}
+
+// envName is the environment variable for a flag, -redis-url is
+// APP_REDIS_URL
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// loadConfig fills in every flag in fs that wasn't given on the command
+// line, first from the environment and then from the config file. It must
+// be called right after fs.Parse
+func loadConfig(fs *flag.FlagSet) error {
+	fs.Visit(func(f *flag.Flag) {
+		cliFlags[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || cliFlags[f.Name] || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value for %s: %v", envName(f.Name), setErr)
+			return
+		}
+		envFlags[f.Name] = true
+	})
+	if err != nil || configPath == "" {
+		return err
+	}
+
+	path := configPath
+	config, err := readConfig(fs, path)
+	if err != nil {
+		return err
+	}
+	for name, values := range config {
+		if cliFlags[name] || envFlags[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for %s in %s: %v", name, path, err)
+			}
+		}
+		configFlags[name] = true
+	}
+	loadedConfig = config
+	return nil
+}
+
+// validateFlags checks the settings make sense on their own and together,
+// once the environment and config file have been applied
+func validateFlags() error {
+	if logFormat != "text" && logFormat != "logfmt" {
+		return fmt.Errorf("-log-format must be text or logfmt, got %q", logFormat)
+	}
+	if !strings.HasPrefix(metricsPath, "/") || metricsPath == "/" || strings.HasSuffix(metricsPath, "/") {
+		return fmt.Errorf("-metrics-path must start with / and not end with one, got %q", metricsPath)
+	}
+	if maxProcs < 0 {
+		return fmt.Errorf("-maxprocs can't be negative, got %d", maxProcs)
+	}
+	if err := checkStaticDir(staticDir); err != nil {
+		return fmt.Errorf("invalid -static-dir: %v", err)
+	}
+	if err := checkBinding(listenAddr); err != nil {
+		return fmt.Errorf("invalid -binding %q: %v, expected host:port like 0.0.0.0:5000, :5000 or [::1]:5000", listenAddr, err)
+	}
+	if (adminUser == "") != (adminPass == "") {
+		return errors.New("both -admin-user and -admin-pass must be set to protect the admin endpoints")
+	}
+	if logMaxRequestID < 8 || logMaxUserAgent < 8 {
+		return fmt.Errorf("-log-max-request-id and -log-max-user-agent must be at least 8, got %d and %d", logMaxRequestID, logMaxUserAgent)
+	}
+	if logSampleRate < 0 || logSampleRate > 1 {
+		return fmt.Errorf("-log-sample-rate must be between 0 and 1, got %v", logSampleRate)
+	}
+	if remoteShutdown && adminUser == "" {
+		return errors.New("-enable-remote-shutdown needs -admin-user and -admin-pass")
+	}
+	if hideRequestID && requestIDTrailers {
+		return errors.New("-request-id-trailer would send the request ID -hide-request-id hides")
+	}
+	if !validHeaderName(requestIDHeader) {
+		return fmt.Errorf("-request-id-header must be a header name, got %q", requestIDHeader)
+	}
+	if hopByHop[textproto.CanonicalMIMEHeaderKey(requestIDHeader)] {
+		return fmt.Errorf("-request-id-header can't be %s, a hop-by-hop header net/http manages", requestIDHeader)
+	}
+	if !requestIDFormats[requestIDFormat] {
+		return fmt.Errorf("-request-id-format must be uuid, nano or counter, got %q", requestIDFormat)
+	}
+	if degradedStatus != 0 && (degradedStatus < 200 || degradedStatus > 599) {
+		return fmt.Errorf("-degraded-status must be an HTTP status from 200 to 599, got %d", degradedStatus)
+	}
+	if startupProfilePath != "" && startupProfileFor <= 0 {
+		return fmt.Errorf("-startup-profile-duration must be positive, got %s", startupProfileFor)
+	}
+	if readinessThreshold < 1 {
+		return fmt.Errorf("-readiness-failure-threshold must be at least 1, got %d", readinessThreshold)
+	}
+	if metricsBackendKind != "none" && metricsBackendKind != "statsd" && metricsBackendKind != "dogstatsd" {
+		return fmt.Errorf("-metrics-backend must be none, statsd or dogstatsd, got %q", metricsBackendKind)
+	}
+	if slashMode != "strip" && slashMode != "add" && slashMode != "off" {
+		return fmt.Errorf("-trailing-slash must be strip, add or off, got %q", slashMode)
+	}
+	if rateLimitBackend != "memory" && rateLimitBackend != "redis" {
+		return fmt.Errorf("-rate-limit-backend must be memory or redis, got %q", rateLimitBackend)
+	}
+	if rateLimit > 0 && rateLimitWindow < time.Second {
+		return fmt.Errorf("-rate-limit-window must be at least 1s, got %s", rateLimitWindow)
+	}
+	if stackMaxLen < 1 {
+		return fmt.Errorf("-stack-max-len must be at least 1, got %d", stackMaxLen)
+	}
+	if stackReadMax < 1 {
+		return fmt.Errorf("-stack-read-max must be at least 1, got %d", stackReadMax)
+	}
+	if maxBatch < 1 {
+		return fmt.Errorf("-max-batch must be at least 1, got %d", maxBatch)
+	}
+	if pusherBatch < 1 {
+		return fmt.Errorf("-pusher-batch must be at least 1, got %d", pusherBatch)
+	}
+	if pusherIntervalMin <= 0 || pusherIntervalMin > pusherIntervalMax {
+		return fmt.Errorf("-pusher-interval-min (%s) must be positive and no more than -pusher-interval-max (%s)", pusherIntervalMin, pusherIntervalMax)
+	}
+	if pusherEnabled && pusherStaleness <= pusherIntervalMax {
+		return fmt.Errorf("-pusher-staleness (%s) must be longer than -pusher-interval-max (%s)", pusherStaleness, pusherIntervalMax)
+	}
+	if noRedis && pusherEnabled {
+		return errors.New("-pusher needs Redis and can't be used with -no-redis")
+	}
+	if noRedis && rateLimit > 0 && rateLimitBackend == "redis" {
+		return errors.New("-rate-limit-backend=redis can't be used with -no-redis")
+	}
+	return nil
+}
+
+// flags never shown by /debug/config
+var secretFlags = map[string]bool{
+	"admin-pass": true,
+}
+
+type configValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// effectiveConfig is the value of every flag and where it came from:
+// "flag", "env", "config" or "default"
+func effectiveConfig() map[string]configValue {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	config := map[string]configValue{}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := configValue{Value: f.Value.String(), Source: "default"}
+		if cliFlags[f.Name] {
+			value.Source = "flag"
+		} else if envFlags[f.Name] {
+			value.Source = "env"
+		} else if configFlags[f.Name] {
+			value.Source = "config"
+		}
+		if secretFlags[f.Name] && value.Value != "" {
+			value.Value = "[redacted]"
+		}
+		config[f.Name] = value
+	})
+	return config
+}
+
+// reloadConfig re-reads the config file and applies what it can to the
+// flags in fs. Anything else that changed is only logged and waits for a
+// restart
+func reloadConfig(fs *flag.FlagSet, logger *log.Logger) {
+	if configPath == "" {
+		return
+	}
+	config, err := readConfig(fs, configPath)
+	if err != nil {
+		logger.Printf("Could not reload config, keeping the current one: %v\n", err)
+		return
+	}
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := config[name]
+		if old, ok := loadedConfig[name]; ok && strings.Join(old, "\n") == strings.Join(values, "\n") {
+			continue
+		}
+		if cliFlags[name] || envFlags[name] {
+			logger.Printf("Ignoring %s from %s, it was set on the command line or environment\n", name, configPath)
+			continue
+		}
+		apply, ok := reloadable[name]
+		if !ok {
+			logger.Printf("%s changed in %s, restart to apply it\n", name, configPath)
+			continue
+		}
+		// only single valued settings are reloadable
+		if err := fs.Set(name, values[len(values)-1]); err != nil {
+			logger.Printf("Invalid value for %s in %s: %v\n", name, configPath, err)
+			continue
+		}
+		configMu.Lock()
+		configFlags[name] = true
+		configMu.Unlock()
+		apply(logger)
+	}
+	loadedConfig = config
+	logger.Printf("Reloaded config from %s\n", configPath)
+}
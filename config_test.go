@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRedisAddrPrecedence(t *testing.T) {
+	file, err := ioutil.TempFile("", "helloworld-config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"redis": "config:6379"}`)
+	file.Close()
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    string
+		config bool
+		want   string
+		source string
+	}{
+		{"default", nil, "", false, "redis:6379", "default"},
+		{"flag", []string{"-redis", "flag:6379"}, "", false, "flag:6379", "flag"},
+		{"env", nil, "env:6379", false, "env:6379", "env"},
+		{"config", nil, "", true, "config:6379", "config"},
+		{"flag beats env", []string{"-redis", "flag:6379"}, "env:6379", false, "flag:6379", "flag"},
+		{"flag beats config", []string{"-redis", "flag:6379"}, "", true, "flag:6379", "flag"},
+		{"env beats config", nil, "env:6379", true, "env:6379", "env"},
+		{"flag beats both", []string{"-redis", "flag:6379"}, "env:6379", true, "flag:6379", "flag"},
+	}
+	defer resetConfigSources()
+	for _, tt := range tests {
+		resetConfigSources()
+		os.Unsetenv("APP_REDIS")
+		if tt.env != "" {
+			os.Setenv("APP_REDIS", tt.env)
+		}
+		args := tt.args
+		if tt.config {
+			args = append([]string{"-config", file.Name()}, args...)
+		}
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		registerFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		err := loadConfig(fs)
+		os.Unsetenv("APP_REDIS")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		client := newRedisClient(currentRedisAddr())
+		if got := client.Options().Addr; got != tt.want {
+			t.Errorf("%s: the client is for %s, want %s", tt.name, got, tt.want)
+		}
+		client.Close()
+		source := "default"
+		if cliFlags["redis"] {
+			source = "flag"
+		} else if envFlags["redis"] {
+			source = "env"
+		} else if configFlags["redis"] {
+			source = "config"
+		}
+		if source != tt.source {
+			t.Errorf("%s: -redis came from %s, want %s", tt.name, source, tt.source)
+		}
+	}
+}
+
+// resetConfigSources forgets where every flag came from, so each
+// loadConfig starts afresh
+func resetConfigSources() {
+	cliFlags = map[string]bool{}
+	envFlags = map[string]bool{}
+	configFlags = map[string]bool{}
+	loadedConfig = nil
+	configPath = ""
+}
+
+func TestReadConfigNumbers(t *testing.T) {
+	file, err := ioutil.TempFile("", "helloworld-config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"stack-max-len": 1000000, "max-batch": 12345678901, "log-sample-rate": 0.25, "debug": true, "header": ["X-A: 1", "X-B: 2"]}`)
+	file.Close()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	config, err := readConfig(fs, file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"stack-max-len":   {"1000000"},
+		"max-batch":       {"12345678901"},
+		"log-sample-rate": {"0.25"},
+		"debug":           {"true"},
+		"header":          {"X-A: 1", "X-B: 2"},
+	}
+	for name, values := range want {
+		if got := strings.Join(config[name], "\n"); got != strings.Join(values, "\n") {
+			t.Errorf("%s is %q, want %q", name, config[name], values)
+		}
+	}
+
+	defer resetConfigSources()
+	resetConfigSources()
+	if err := fs.Parse([]string{"-config", file.Name()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if stackMaxLen != 1000000 {
+		t.Errorf("-stack-max-len is %d, want 1000000", stackMaxLen)
+	}
+}
+
+// SIGHUPs while requests are in flight, run with -race to be of any use
+func TestReloadUnderLoad(t *testing.T) {
+	a := startFakeRedis(t, 0)
+	defer a.close()
+	b := startFakeRedis(t, 0)
+	defer b.close()
+	file, err := ioutil.TempFile("", "helloworld-config-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	// the flag set reloads go through, it's bound to the same variables as
+	// the one the server starts with
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	s := startTestServer(t, "-no-redis=false", "-redis", a.addr(), "-admin-pass", "secret")
+	defer s.Close()
+	defer resetConfigSources()
+	resetConfigSources()
+	configPath = file.Name()
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	auth := req.Header.Get("Authorization")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for _, path := range []string{"/", "/stack", "/readyz", "/debug/config", "/metrics"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest(http.MethodGet, s.URL+path, nil)
+				req.Header.Set("Authorization", auth)
+				if res, err := http.DefaultClient.Do(req); err == nil {
+					res.Body.Close()
+				}
+			}
+		}(path)
+	}
+
+	logger := log.New(ioutil.Discard, "", 0)
+	want := a.addr()
+	for i := 0; i < 20; i++ {
+		want = a.addr()
+		if i%2 == 1 {
+			want = b.addr()
+		}
+		if err := ioutil.WriteFile(file.Name(), []byte(fmt.Sprintf(`{"redis": %q}`, want)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reloadConfig(fs, logger)
+		if err := checkTemplate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := currentRedis().Options().Addr; got != want {
+		t.Errorf("the client is for %s after the last reload, want %s", got, want)
+	}
+	if res, _ := s.get(t, "/"); res.StatusCode != http.StatusOK {
+		t.Errorf("/ is %d after the reloads, want 200", res.StatusCode)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTracker knows what state every open connection is in, through the
+// server's ConnState hook
+type connTracker struct {
+	// handlers that haven't returned, counted by countRunning. The server
+	// stops waiting on a connection once it is hijacked, these don't. First
+	// so it is 64-bit aligned for atomic on 32-bit platforms
+	running int64
+
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{states: map[net.Conn]http.ConnState{}}
+}
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(t.states, c)
+		return
+	}
+	t.states[c] = state
+}
+
+// closeIn closes every connection in one of states and says how many
+// that was
+func (t *connTracker) closeIn(states ...http.ConnState) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	closed := 0
+	for c, state := range t.states {
+		for _, s := range states {
+			if state == s {
+				c.Close()
+				closed++
+				break
+			}
+		}
+	}
+	return closed
+}
+
+// count is how many connections are in each state
+func (t *connTracker) count() map[http.ConnState]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts := map[http.ConnState]int{}
+	for _, state := range t.states {
+		counts[state]++
+	}
+	return counts
+}
+
+// countRunning keeps count of next's calls that haven't returned. h2c
+// serves a whole connection from one call, so it only returns once that
+// connection is done
+func (t *connTracker) countRunning(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&t.running, 1)
+		defer atomic.AddInt64(&t.running, -1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitRunning waits for every call counted by countRunning to return, or
+// for ctx to be done, checking the way http.Server.Shutdown does
+func (t *connTracker) waitRunning(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&t.running) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
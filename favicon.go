@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"time"
+)
+
+// defaultFavicon is a 16x16 blue dot, served when -static-dir has no
+// favicon.ico of its own
+var defaultFavicon = []byte{
+	0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x10, 0x10, 0x00, 0x00, 0x01, 0x00,
+	0x20, 0x00, 0x69, 0x00, 0x00, 0x00, 0x16, 0x00, 0x00, 0x00, 0x89, 0x50,
+	0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48,
+	0x44, 0x52, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x10, 0x08, 0x06,
+	0x00, 0x00, 0x00, 0x1f, 0xf3, 0xff, 0x61, 0x00, 0x00, 0x00, 0x30, 0x49,
+	0x44, 0x41, 0x54, 0x78, 0xda, 0x63, 0x60, 0xa0, 0x36, 0x90, 0xeb, 0x78,
+	0xfa, 0x1f, 0x1f, 0xa6, 0x48, 0x33, 0x5e, 0x43, 0x88, 0xd5, 0x8c, 0xd5,
+	0x10, 0x52, 0x35, 0x63, 0x18, 0x32, 0x6a, 0xc0, 0xb0, 0x30, 0x80, 0xe2,
+	0x84, 0x44, 0x95, 0xa4, 0x4c, 0x95, 0xcc, 0x44, 0x0e, 0x00, 0x00, 0x4b,
+	0xba, 0xb4, 0xc8, 0x40, 0x83, 0x7d, 0x5f, 0x00, 0x00, 0x00, 0x00, 0x49,
+	0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+// favicon serves favicon.ico from -static-dir if there is one, otherwise
+// the built in icon, with a week's cache either way
+func favicon(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	if f, err := os.Open(staticFile("favicon.ico")); err == nil {
+		defer f.Close()
+		if info, err := f.Stat(); err == nil && !info.IsDir() {
+			http.ServeContent(w, r, "favicon.ico", info.ModTime(), f)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	http.ServeContent(w, r, "favicon.ico", time.Time{}, bytes.NewReader(defaultFavicon))
+}
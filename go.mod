@@ -5,4 +5,7 @@ go 1.13
 require (
 	github.com/go-redis/redis v6.14.0+incompatible
 	github.com/onsi/ginkgo v1.13.0 // indirect
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44
 )
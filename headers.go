@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// headerFlags collects repeated -header "Name: Value" flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var pairs []string
+	for name, values := range h {
+		for _, value := range values {
+			pairs = append(pairs, name+": "+value)
+		}
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlags) Set(pair string) error {
+	colon := strings.Index(pair, ":")
+	if colon < 1 {
+		return fmt.Errorf(`header %q must look like "Name: Value"`, pair)
+	}
+	name := strings.TrimSpace(pair[:colon])
+	value := strings.TrimSpace(pair[colon+1:])
+	if !validHeaderName(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if hopByHop[textproto.CanonicalMIMEHeaderKey(name)] {
+		return fmt.Errorf("%s is a hop-by-hop header net/http manages, it can't be set with -header", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header %s has a line break in its value", name)
+	}
+	http.Header(h).Add(textproto.CanonicalMIMEHeaderKey(name), value)
+	return nil
+}
+
+// connection level headers that -header can't set, getting them wrong
+// would contradict what the server actually does with the connection
+var hopByHop = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Te":                true,
+	"Trailer":           true,
+	"Upgrade":           true,
+}
+
+// validHeaderName checks name is an RFC 7230 token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c > 127 || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// addHeaders sets the configured headers on every response
+func addHeaders(headers http.Header) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(headers) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a copy each, an Add later on would otherwise append into
+			// the slice every response shares
+			for name, values := range headers {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keepAliveHint sends Keep-Alive: timeout=N, N being -idle-timeout in
+// seconds, so clients know how long they can reuse the connection. Only on
+// HTTP/1.x, where keep-alive is a thing, and not once keep-alives are off
+// or shutdown has started and the server is closing connections anyway
+func keepAliveHint(enabled bool, idle time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled || !keepAlives || idle < time.Second {
+			return next
+		}
+		value := "timeout=" + strconv.Itoa(int(idle/time.Second))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor == 1 && !r.Close && atomic.LoadInt32(&healthy) == 1 {
+				w.Header().Set("Keep-Alive", value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddHeadersCopiesValues(t *testing.T) {
+	headers := http.Header{}
+	for _, v := range []string{"a", "b", "c"} {
+		headers.Add("X-Extra", v)
+	}
+	h := addHeaders(headers)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("X-Extra", "mine")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got := w.Header()["X-Extra"]; len(got) != 4 || got[3] != "mine" {
+		t.Errorf("the response has X-Extra %q, want a, b, c and mine", got)
+	}
+	shared := headers["X-Extra"]
+	for _, v := range shared[:cap(shared)] {
+		if v == "mine" {
+			t.Fatalf("a response's Add wrote into the configured headers: %q", shared[:cap(shared)])
+		}
+	}
+}
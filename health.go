@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthz is liveness: if we can answer, we're alive. It deliberately
+// ignores healthy, which goes to 0 at the start of shutdown so readyz can
+// take us out of the load balancer during -pre-shutdown-delay. Failing
+// liveness then would get the process killed before it has drained
+//
+// With maxGoroutines above 0 it also fails once there are more goroutines
+// than that, so a process that is leaking them gets restarted
+func healthz(maxGoroutines int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := runtime.NumGoroutine(); maxGoroutines > 0 && n > maxGoroutines {
+			requestLogger(r.Context()).Printf("Not alive: %d goroutines is over -max-goroutines %d\n", n, maxGoroutines)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type readiness struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyz is not ready from the moment shutdown starts. When the pusher is
+// running it also checks that it is still managing to push and, with
+// -ready-check-static, that the page template can be read. The body says
+// which check failed
+//
+// Those checks are shared by every probe within cacheTTL of the last one
+// that ran them, and only make us unready once threshold runs in a row
+// have failed. Shutting down and draining always show straight away
+func readyz(p *pusher, cacheTTL time.Duration, threshold int) http.Handler {
+	var (
+		mu        sync.Mutex
+		checkedAt time.Time
+		lastReady bool
+		lastCheck map[string]string
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if lastCheck == nil || time.Since(checkedAt) >= cacheTTL {
+			lastReady, lastCheck = readinessChecks(p)
+			checkedAt = time.Now()
+			if lastReady {
+				atomic.StoreInt64(&readinessFailures, 0)
+			} else {
+				atomic.AddInt64(&readinessFailures, 1)
+			}
+		}
+		ready := lastReady || atomic.LoadInt64(&readinessFailures) < int64(threshold)
+		checks := map[string]string{"server": "ok"}
+		for name, result := range lastCheck {
+			checks[name] = result
+		}
+		mu.Unlock()
+
+		if atomic.LoadInt32(&healthy) != 1 {
+			ready = false
+			checks["server"] = "shutting down"
+		} else if atomic.LoadInt32(&drained) == 1 {
+			ready = false
+			checks["server"] = "drained"
+		}
+
+		result := readiness{Status: "ready", Checks: checks}
+		code := http.StatusOK
+		if !ready {
+			result.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, r, code, result)
+	})
+}
+
+// failed readiness checks in a row, published as readiness_failures
+var readinessFailures int64
+
+// readinessChecks checks what readyz depends on besides the server itself
+func readinessChecks(p *pusher) (bool, map[string]string) {
+	ready := true
+	checks := map[string]string{}
+	if p != nil {
+		checks["pusher"] = "ok"
+		if !p.healthy(pusherStaleness) {
+			ready = false
+			checks["pusher"] = "stale"
+		}
+	}
+
+	// Redis being down doesn't make us unready, the page works without
+	// it, but the body still says why it isn't connected. Not knowing
+	// yet does, the page would only say the service is starting
+	if !noRedis {
+		checks["redis"] = redisStats.currentStatus()
+		if checks["redis"] == "" {
+			ready = false
+			checks["redis"] = "checking"
+		}
+	}
+	if readyCheckStatic {
+		checks["static"] = "ok"
+		if err := staticReadable(); err != nil {
+			ready = false
+			checks["static"] = err.Error()
+		}
+	}
+	return ready, checks
+}
+
+// set by /drain, 1 while readyz should fail so we get taken out of the
+// load balancer but carry on serving
+var drained int32
+
+// drain handles /drain and /undrain. It only changes readiness, liveness
+// and the server itself are left alone
+func drain(on bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		status := "serving"
+		var state int32
+		if on {
+			status, state = "drained", 1
+		}
+		if atomic.SwapInt32(&drained, state) != state {
+			if on {
+				requestLogger(r.Context()).Printf("Drained by %s, /readyz fails until /undrain\n", clientIP(r))
+			} else {
+				requestLogger(r.Context()).Println("Undrained by", clientIP(r))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"` + status + `"}` + "\n"))
+	})
+}
+
+// writeHealth writes a health check result. HEAD requests get the same
+// headers, including the length, but no body
+func writeHealth(w http.ResponseWriter, r *http.Request, code int, result interface{}) {
+	body, _ := json.Marshal(result)
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// staticReadable opens the page template, catching a static volume that
+// failed to mount and would otherwise render an empty page
+func staticReadable() error {
+	f, err := os.Open(templatePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", templatePath())
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	for _, args := range [][]string{nil, {"-gzip"}} {
+		testReadyz(t, args...)
+	}
+}
+
+// testReadyz checks GET and HEAD agree. HEAD asks for gzip, which it
+// shouldn't get as there is no body to compress
+func testReadyz(t *testing.T, args ...string) {
+	s := startTestServer(t, args...)
+	defer s.Close()
+
+	for _, ready := range []bool{true, false} {
+		var state int32
+		want, status := http.StatusOK, "ready"
+		if !ready {
+			state, want, status = 1, http.StatusServiceUnavailable, "not ready"
+		}
+		atomic.StoreInt32(&drained, state)
+
+		res, body := s.get(t, "/readyz", "Accept-Encoding", "identity")
+		if res.StatusCode != want {
+			t.Errorf("%v GET ready=%v: got %d, want %d", args, ready, res.StatusCode, want)
+		}
+		var result readiness
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatalf("%v GET ready=%v: %v in %q", args, ready, err, body)
+		}
+		if result.Status != status {
+			t.Errorf("%v GET ready=%v: status is %q, want %q", args, ready, result.Status, status)
+		}
+
+		head, headBody := s.do(t, http.MethodHead, "/readyz", "Accept-Encoding", "gzip")
+		if head.StatusCode != want {
+			t.Errorf("%v HEAD ready=%v: got %d, want %d", args, ready, head.StatusCode, want)
+		}
+		if got := head.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+			t.Errorf("%v HEAD ready=%v: Content-Length is %q, want the GET body's %d", args, ready, got, len(body))
+		}
+		if got := head.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("%v HEAD ready=%v: Content-Encoding is %q, want none", args, ready, got)
+		}
+		if headBody != "" {
+			t.Errorf("%v HEAD ready=%v: got a body %q", args, ready, headBody)
+		}
+	}
+}
+
+func TestLivez(t *testing.T) {
+	for _, ready := range []bool{true, false} {
+		var args []string
+		want := http.StatusNoContent
+		if !ready {
+			// far fewer goroutines than the test binary has running
+			args, want = []string{"-max-goroutines", "1"}, http.StatusServiceUnavailable
+		}
+		s := startTestServer(t, args...)
+		atomic.StoreInt32(&healthy, 0) // liveness doesn't care about shutdown
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			res, body := s.do(t, method, "/livez")
+			if res.StatusCode != want {
+				t.Errorf("%s alive=%v: got %d, want %d", method, ready, res.StatusCode, want)
+			}
+			if body != "" {
+				t.Errorf("%s alive=%v: got a body %q", method, ready, body)
+			}
+		}
+		s.Close()
+	}
+}
+
+// readinessFailures goes up once for each time the checks actually run,
+// they fail here until a Redis check has said what state it is in
+func TestReadyzSharesChecks(t *testing.T) {
+	fake := startFakeRedis(t, 0)
+	defer fake.close()
+
+	for _, ttl := range []string{"1m", "0s"} {
+		s := startTestServer(t, "-no-redis=false", "-redis", fake.addr(), "-readiness-cache-ttl", ttl)
+		pinged := fake.pinged()
+		const n = 20
+		for i := 0; i < n; i++ {
+			if res, _ := s.get(t, "/readyz"); res.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("ttl %s: got %d, want 503 before Redis was checked", ttl, res.StatusCode)
+			}
+		}
+		s.Close()
+
+		var want int64 = 1
+		if ttl == "0s" {
+			want = n
+		}
+		if got := atomic.LoadInt64(&readinessFailures); got != want {
+			t.Errorf("ttl %s: %d probes ran the checks %d times, want %d", ttl, n, got, want)
+		}
+		if got := fake.pinged() - pinged; got > 1 {
+			t.Errorf("ttl %s: %d probes sent %d PINGs, want at most 1", ttl, n, got)
+		}
+	}
+}
+
+// readyz fails from the start of shutdown so the load balancer lets go,
+// while livez and everything else carry on through -pre-shutdown-delay
+func TestPreShutdownDelay(t *testing.T) {
+	s := startTestServer(t, "-pre-shutdown-delay", "300ms")
+	defer s.Close()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- shutdownServer(s.Config, newConnTracker(), make(chan struct{}), log.New(ioutil.Discard, "", 0))
+	}()
+	waitFor(t, "shutdown to start", func() bool { return atomic.LoadInt32(&healthy) == 0 })
+
+	for path, want := range map[string]int{"/readyz": http.StatusServiceUnavailable, "/livez": http.StatusNoContent, "/uptime": http.StatusOK} {
+		res, body := s.get(t, path)
+		if res.StatusCode != want {
+			t.Errorf("%s during the delay: got %d, want %d: %s", path, res.StatusCode, want, body)
+		}
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown finished before the delay was up: %v", err)
+	default:
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
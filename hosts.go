@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseHosts splits the comma separated -allowed-hosts into a set of
+// lower-case host names
+func parseHosts(list string) map[string]bool {
+	hosts := map[string]bool{}
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// hostAllowed matches the Host header with and without its port, so
+// example.com lets in example.com:5000 too
+func hostAllowed(hosts map[string]bool, host string) bool {
+	host = strings.ToLower(host)
+	if hosts[host] {
+		return true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return hosts[name]
+	}
+	return false
+}
+
+// allowedHosts turns away requests for any other Host with a 421, so a
+// forged Host header can't end up in redirects or a shared cache. Anything
+// goes when hosts is empty
+func allowedHosts(hosts map[string]bool, skip map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(hosts) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !skip[r.URL.Path] && !hostAllowed(hosts, r.Host) {
+				writeJSONError(w, r, http.StatusMisdirectedRequest, "unknown host")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAllowedHosts(t *testing.T) {
+	tests := []struct {
+		args   []string
+		path   string
+		host   string
+		status int
+	}{
+		{nil, "/uptime", "anything.example", http.StatusOK},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/uptime", "example.com", http.StatusOK},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/uptime", "WWW.Example.com:5000", http.StatusOK},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/uptime", "evil.example", http.StatusMisdirectedRequest},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/uptime", "example.com.evil.example", http.StatusMisdirectedRequest},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/livez", "10.0.0.7:5000", http.StatusNoContent},
+		{[]string{"-allowed-hosts", "example.com, www.example.com"}, "/readyz", "10.0.0.7:5000", http.StatusOK},
+	}
+	for _, tt := range tests {
+		s := startTestServer(t, tt.args...)
+		res, _ := s.get(t, tt.path, "Host", tt.host)
+		s.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%v %s for %s: got %d, want %d", tt.args, tt.path, tt.host, res.StatusCode, tt.status)
+		}
+	}
+}
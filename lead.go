@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type leadText struct {
+	connected  string
+	standalone string
+	checking   string
+}
+
+// which lead the home page shows
+type leadState int32
+
+const (
+	leadStandalone leadState = iota
+	leadConnected
+	// Redis is configured but no check has finished yet
+	leadChecking
+)
+
+func (s leadState) String() string {
+	switch s {
+	case leadConnected:
+		return "connected"
+	case leadChecking:
+		return "checking"
+	}
+	return "standalone"
+}
+
+const defaultLanguage = "en"
+
+// the home page lead in every language we have it in
+var leadMessages = map[string]leadText{
+	"en": {
+		connected:  "This is a simple service application(connected to Redis). Deployed by Cloud 66 ~",
+		standalone: "This is a simple single service application. Deployed by Cloud 66",
+		checking:   "Service starting...",
+	},
+	"es": {
+		connected:  "Esta es una aplicación de servicio sencilla (conectada a Redis). Desplegada por Cloud 66 ~",
+		standalone: "Esta es una aplicación sencilla de un solo servicio. Desplegada por Cloud 66",
+		checking:   "Servicio iniciándose...",
+	},
+	"fr": {
+		connected:  "Ceci est une application de service simple (connectée à Redis). Déployée par Cloud 66 ~",
+		standalone: "Ceci est une application simple à service unique. Déployée par Cloud 66",
+		checking:   "Service en cours de démarrage...",
+	},
+	"de": {
+		connected:  "Dies ist eine einfache Service-Anwendung (mit Redis verbunden). Bereitgestellt von Cloud 66 ~",
+		standalone: "Dies ist eine einfache Einzelservice-Anwendung. Bereitgestellt von Cloud 66",
+		checking:   "Dienst wird gestartet...",
+	},
+}
+
+// leadMessage picks the lead for a language. A message set with
+// -lead-connected, -lead-standalone or -lead-checking is used whatever the
+// language, since we have no translations of it
+func leadMessage(lang string, state leadState) string {
+	text := leadMessages[lang]
+	switch state {
+	case leadConnected:
+		if leadConnectedText != leadMessages[defaultLanguage].connected {
+			return leadConnectedText
+		}
+		return text.connected
+	case leadChecking:
+		if leadCheckingText != leadMessages[defaultLanguage].checking {
+			return leadCheckingText
+		}
+		return text.checking
+	}
+	if leadStandaloneText != leadMessages[defaultLanguage].standalone {
+		return leadStandaloneText
+	}
+	return text.standalone
+}
+
+// preferredLanguage returns the language from an Accept-Language header we
+// have messages for, preferring higher q values, or English
+func preferredLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		// only the primary subtag matters, es-MX is served es
+		lang := strings.ToLower(strings.SplitN(strings.TrimSpace(fields[0]), "-", 2)[0])
+		if lang == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{lang, q})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	for _, c := range candidates {
+		if _, ok := leadMessages[c.lang]; ok {
+			return c.lang
+		}
+	}
+	return defaultLanguage
+}
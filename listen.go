@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkBinding catches a malformed -binding before we try to listen on it,
+// which would fail with a much less helpful error
+func checkBinding(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if addrErr, ok := err.(*net.AddrError); ok {
+			return fmt.Errorf("%s", addrErr.Err)
+		}
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q is not a number from 0 to 65535", port)
+	}
+	if host != "" && net.ParseIP(host) == nil && strings.ContainsAny(host, ":/ ") {
+		return fmt.Errorf("%q is not an IP address or host name", host)
+	}
+	return nil
+}
+
+// the first file descriptor systemd passes, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// systemdListener is the socket systemd passed us with socket activation,
+// nil when it didn't. LISTEN_PID has to be us, otherwise the variables were
+// meant for a parent and were only inherited
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	// so nothing we start thinks they are meant for it
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, only one is supported", n)
+	}
+	f := os.NewFile(listenFDsStart, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// listen binds addr, with SO_REUSEPORT set when reusePort is true and the
+// platform has it. Without it the flag is ignored with a warning
+func listen(addr string, reusePort bool, logger *log.Logger) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		if reusePortControl != nil {
+			lc.Control = reusePortControl
+		} else {
+			logger.Println("SO_REUSEPORT is not supported on this platform, ignoring -reuseport")
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// newLogger makes the app's logger in the -log-format in use
+func newLogger() *log.Logger {
+	if logFormat == "logfmt" {
+		return log.New(&logfmtWriter{out: os.Stdout}, "", 0)
+	}
+	return log.New(os.Stdout, "http: ", log.LstdFlags)
+}
+
+// logfmtWriter turns each log entry into a line of key=value pairs. A
+// message written through a log.Logger becomes msg=, with the time and any
+// fixed fields in front
+type logfmtWriter struct {
+	out    io.Writer
+	fields string
+}
+
+func (w *logfmtWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	if err := w.writePairs(logfmtPair("msg", msg)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writePairs writes an entry that is already key=value pairs
+func (w *logfmtWriter) writePairs(pairs string) error {
+	_, err := io.WriteString(w.out, logfmtPair("time", time.Now().UTC().Format(time.RFC3339Nano))+" "+w.fields+pairs+"\n")
+	return err
+}
+
+// with is a writer that adds key=value to every entry
+func (w *logfmtWriter) with(key, value string) *logfmtWriter {
+	return &logfmtWriter{out: w.out, fields: w.fields + logfmtPair(key, value) + " "}
+}
+
+// truncate cuts s to at most max bytes, ending in "..." when it had to,
+// so a single request can't write a huge log line
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max - len("...")
+	if cut < 0 {
+		cut = 0
+	}
+	// don't split a UTF-8 sequence
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
+
+// logfmtPair quotes value when it is empty or has spaces, quotes, = or
+// anything unprintable in it
+func logfmtPair(key, value string) string {
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return key + "=" + strconv.Quote(value)
+	}
+	return key + "=" + value
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// a huge User-Agent is cut to -log-max-user-agent in the request log
+func TestLogTruncatesUserAgent(t *testing.T) {
+	agent := "agent/" + strings.Repeat("x", 10000)
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, agent[:253] + "..."},
+		{[]string{"-log-max-user-agent", "16"}, "agent/xxxxxxx..."},
+	}
+	for _, tt := range tests {
+		s := startTestServer(t, tt.args...)
+		s.get(t, "/uptime", "User-Agent", agent)
+		s.Close()
+
+		logs := s.logs.String()
+		if !strings.Contains(logs, tt.want+" ") {
+			t.Errorf("%v: the User-Agent wasn't cut to %d bytes:\n%.400s", tt.args, len(tt.want), logs)
+		}
+		if strings.Contains(logs, agent[:len(tt.want)]) {
+			t.Errorf("%v: more of the User-Agent than %d bytes was logged", tt.args, len(tt.want))
+		}
+	}
+
+	// logfmt quotes nothing here, the cut value is a single token
+	setTestFlags(t, "-log-format", "logfmt", "-log-max-user-agent", "16")
+	defer setRedis(nil)
+	logs := &syncBuffer{}
+	h := newHandler(newRouter(nil, nil, make(chan os.Signal, 1)), noMetrics{}, log.New(&logfmtWriter{out: logs}, "", 0), nil)
+	req := httptest.NewRequest(http.MethodGet, "/uptime", nil)
+	req.Header.Set("User-Agent", agent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(logs.String(), " user_agent=agent/xxxxxxx... ") {
+		t.Errorf("logfmt: the User-Agent wasn't cut to 16 bytes:\n%.400s", logs.String())
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"short", 8, "short"},
+		{"exactly8", 8, "exactly8"},
+		{"one too long", 11, "one too ..."},
+		// the cut backs off to the start of "é" rather than split it
+		{"abcdé and more", 8, "abcd..."},
+		{"日本語のエージェント", 10, "日本..."},
+	}
+	for _, tt := range tests {
+		got := truncate(tt.s, tt.max)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) is %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+		if len(got) > tt.max || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) is %q, over the limit or not UTF-8", tt.s, tt.max, got)
+		}
+	}
+}
@@ -1,155 +1,1150 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
 	"flag"
 	"fmt"
+	"html"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/go-redis/redis"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type key int
 
 const (
 	requestIDKey key = 0
+	loggerKey    key = 1
+	recoveryKey  key = 2
 )
 
 var (
 	listenAddr string
+	// read and written under redisMu, see redisAddrFlag
 	redisAddr  string
-	healthy    int32
+	noRedis    bool
+	basePath   string
+	staticDir  string
+	slashMode  string
+	debugMode  bool
+	logFormat  string
+	adminUser  string
+	adminPass  string
+	check      bool
+	showBanner bool
+	h2cEnabled bool
+	keepAlives bool
+	sendfile   bool
+	reusePort  bool
+	quitDump   bool
+	maxProcs   int
+
+	redisCheckInterval time.Duration
+	redisLogWindow     time.Duration
+	redisWarmupTimeout time.Duration
+	idleTimeout        time.Duration
+	shutdownTimeout    time.Duration
+	drainIdleGrace     time.Duration
+	requestTimeoutDef  time.Duration
+	requestTimeoutMax  time.Duration
+
+	remoteShutdown bool
+	extraHeaders   = headerFlags{}
+	cacheMaxAge    = cacheMaxAges{".jpg": 86400, ".css": 3600}
+
+	gzipEnabled bool
+	gzipLevel   = compressionLevel(6)
+
+	slowRequestThreshold time.Duration
+	maxGoroutines        int
+	auditLogPath         string
+	requestIDTrailers    bool
+	requestIDFormat      string
+	hideRequestID        bool
+	requestIDHeader      string
+	readyCheckStatic     bool
+	readinessCacheTTL    time.Duration
+	readinessThreshold   int
+	templateFallback     bool
+	logSampleRate        float64
+	logErrorsOnly        bool
+	logMaxRequestID      int
+	logMaxUserAgent      int
+
+	preShutdownDelay   time.Duration
+	conditionalGet     bool
+	keepAliveHeader    bool
+	trustedProxyList   string
+	allowedHostList    string
+	metricsAllowList   string
+	leadConnectedText  string
+	leadStandaloneText string
+	leadCheckingText   string
+	pageTitle          string
+	degradedStatus     int
+
+	rateLimit        int
+	rateLimitWindow  time.Duration
+	rateLimitBackend string
+
+	pusherEnabled   bool
+	pusherStaleness time.Duration
+	stackKey        string
+	stackMaxLen     int64
+	stackReadMax    int64
+	maxBatch        int
+
+	pusherBatch       int
+	pusherIntervalMin time.Duration
+	pusherIntervalMax time.Duration
+
+	redisPrefix string
+	metricsPath string
+	disableRoot bool
+
+	startupProfilePath string
+	startupProfileFor  time.Duration
+
+	metricsBackendKind string
+	statsdAddr         string
+	statsdPrefix       string
+
+	healthy int32
 )
 
+// registerFlags binds every flag to its variable in fs, which puts all but
+// the flag.Var ones back to their defaults
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configPath, "config", "", "JSON file of flag values, reloaded on SIGHUP (not required)")
+	fs.StringVar(&listenAddr, "binding", "0.0.0.0:5000", "Server listen address")
+	fs.Var(newRedisAddrFlag(&redisAddr, "redis:6379"), "redis", "Redis `address` (not required)")
+	fs.StringVar(&redisPrefix, "redis-prefix", "", "Namespace for every Redis key, \"helloworld\" makes the stack helloworld:stack")
+	fs.StringVar(&slashMode, "trailing-slash", "strip", "Redirect paths to be without (strip) or with (add) a trailing slash, or off")
+	fs.StringVar(&staticDir, "static-dir", "./static", "Directory with the page template, 404 page and static files")
+	fs.DurationVar(&redisWarmupTimeout, "redis-warmup-timeout", 3*time.Second, "How long startup waits for the first Redis check")
+	fs.StringVar(&metricsPath, "metrics-path", "/metrics", "Path to serve metrics on, under -base-path")
+	fs.BoolVar(&disableRoot, "disable-root", false, "Don't serve the home page, only the API, health, metrics and static files")
+	fs.BoolVar(&noRedis, "no-redis", false, "Run without Redis at all")
+	fs.DurationVar(&redisCheckInterval, "redis-check-interval", 10*time.Second, "How often to check Redis in the background, 0 to only check on requests")
+	fs.DurationVar(&redisLogWindow, "redis-log-window", time.Minute, "Count rather than log Redis connection changes this soon after the last one logged, 0 to log them all")
+	fs.StringVar(&basePath, "base-path", "", "Path prefix for all routes when served behind a proxy (e.g. /hello)")
+	fs.BoolVar(&debugMode, "debug", false, "Log debug lines and show sensitive headers in /whoami")
+	fs.StringVar(&adminUser, "admin-user", "", "Username for the admin endpoints (not required)")
+	fs.StringVar(&adminPass, "admin-pass", "", "Password for the admin endpoints (not required)")
+	fs.StringVar(&metricsAllowList, "metrics-allow-cidr", "", "Comma separated IPs/CIDRs that can read /metrics without admin credentials")
+	fs.StringVar(&allowedHostList, "allowed-hosts", "", "Comma separated Host names to serve, others get a 421 (default any)")
+	fs.StringVar(&trustedProxyList, "trusted-proxies", "", "Comma separated IPs/CIDRs of proxies whose X-Forwarded-Proto is honoured")
+	fs.StringVar(&pageTitle, "page-title", "Hello!", "Title of the home page")
+	fs.StringVar(&leadConnectedText, "lead-connected", leadMessages[defaultLanguage].connected, "Message on the home page when Redis is connected")
+	fs.StringVar(&leadStandaloneText, "lead-standalone", leadMessages[defaultLanguage].standalone, "Message on the home page without Redis")
+	fs.StringVar(&leadCheckingText, "lead-checking", leadMessages[defaultLanguage].checking, "Message on the home page before the first Redis check has finished")
+	fs.IntVar(&rateLimit, "rate-limit", 0, "Maximum requests per client IP per window, 0 for no limit")
+	fs.DurationVar(&rateLimitWindow, "rate-limit-window", time.Minute, "Window the rate limit applies to")
+	fs.StringVar(&startupProfilePath, "startup-profile", "", "File to write a CPU profile of startup to")
+	fs.DurationVar(&startupProfileFor, "startup-profile-duration", 10*time.Second, "How long after startup -startup-profile covers")
+	fs.StringVar(&metricsBackendKind, "metrics-backend", "none", "Also send request metrics to none, statsd or dogstatsd")
+	fs.StringVar(&statsdAddr, "statsd-addr", "127.0.0.1:8125", "UDP address of the StatsD agent")
+	fs.StringVar(&statsdPrefix, "statsd-prefix", "helloworld.", "Prefix of every metric sent to StatsD")
+	fs.StringVar(&rateLimitBackend, "rate-limit-backend", "memory", "Where rate limit counts are kept: memory (per instance) or redis (shared)")
+	fs.BoolVar(&remoteShutdown, "enable-remote-shutdown", false, "Allow a graceful shutdown with POST /shutdown (needs -admin-user)")
+	fs.StringVar(&logFormat, "log-format", "text", "Log as text or logfmt")
+	fs.IntVar(&logMaxRequestID, "log-max-request-id", 128, "Longest request ID written to the log, longer ones are cut short")
+	fs.IntVar(&logMaxUserAgent, "log-max-user-agent", 256, "Longest User-Agent written to the log, longer ones are cut short")
+	fs.BoolVar(&logErrorsOnly, "log-errors-only", false, "Only write access log lines for 4xx and 5xx responses")
+	fs.Float64Var(&logSampleRate, "log-sample-rate", 1, "Fraction of successful requests to write access log lines for, errors are always logged")
+	fs.Var(cacheMaxAge, "cache-max-age", "Browser cache max-age in seconds for static files by extension, as \".jpg=86400,.css=3600\"")
+	fs.BoolVar(&gzipEnabled, "gzip", false, "Compress text responses for clients that accept gzip")
+	fs.Var(&gzipLevel, "compression-level", "gzip level, 1 to 9 or best-speed, default or best-compression")
+	fs.Var(extraHeaders, "header", "Header to add to every response as \"Name: Value\", can be repeated")
+	fs.DurationVar(&slowRequestThreshold, "slow-request-threshold", 0, "Log a warning with a goroutine dump for requests slower than this, 0 to disable")
+	fs.IntVar(&maxGoroutines, "max-goroutines", 0, "Fail /livez when there are more goroutines than this, 0 to disable")
+	fs.BoolVar(&templateFallback, "template-fallback", false, "Serve a built-in page instead of refusing to start when the template is broken")
+	fs.BoolVar(&hideRequestID, "hide-request-id", false, "Don't send the request ID back to clients, only log it")
+	fs.StringVar(&requestIDHeader, "request-id-header", "X-Request-Id", "Header the request ID is read from and sent back in, like X-Correlation-Id")
+	fs.StringVar(&requestIDFormat, "request-id-format", "uuid", "How to make request IDs: uuid, nano (the time in nanoseconds) or counter")
+	fs.BoolVar(&requestIDTrailers, "request-id-trailer", false, "Also send the request ID header as a trailer on chunked responses")
+	fs.StringVar(&auditLogPath, "audit-log", "", "File to append an audit record of every request to (not required)")
+	fs.BoolVar(&readyCheckStatic, "ready-check-static", false, "Have /readyz also check that the static files can be read")
+	fs.IntVar(&readinessThreshold, "readiness-failure-threshold", 1, "Failed /readyz checks in a row before reporting not ready")
+	fs.DurationVar(&readinessCacheTTL, "readiness-cache-ttl", time.Second, "How long /readyz reuses the result of its checks, so bursts of probes share one")
+	fs.BoolVar(&showBanner, "banner", false, "Print a banner with the app name and version at startup")
+	fs.BoolVar(&quitDump, "sigquit-dump", false, "Log a goroutine dump on SIGQUIT and keep running, instead of exiting")
+	fs.IntVar(&maxProcs, "maxprocs", 0, "GOMAXPROCS to run with, 0 to take it from the container CPU limit")
+	fs.BoolVar(&check, "check", false, "Verify the configuration and exit without serving traffic")
+	fs.BoolVar(&h2cEnabled, "h2c", false, "Also serve HTTP/2 over cleartext (h2c)")
+	fs.BoolVar(&reusePort, "reuseport", false, "Set SO_REUSEPORT so a new process can bind the same port while this one drains (Linux and BSD)")
+	fs.BoolVar(&keepAlives, "keep-alives", true, "Keep HTTP/1.1 connections open between requests")
+	fs.BoolVar(&keepAliveHeader, "keep-alive-header", false, "Send Keep-Alive: timeout=N on HTTP/1.1 responses, N being -idle-timeout")
+	fs.BoolVar(&sendfile, "sendfile", true, "Send static files straight from disk to the connection where the OS supports it")
+	fs.DurationVar(&requestTimeoutDef, "request-timeout", 0, "Deadline for handling a request when the client doesn't send X-Request-Timeout, 0 for none")
+	fs.DurationVar(&requestTimeoutMax, "max-request-timeout", 0, "Cap on the deadline a client can ask for with X-Request-Timeout, 0 to ignore the header")
+	fs.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to finish when shutting down")
+	fs.DurationVar(&drainIdleGrace, "drain-idle-grace", time.Second, "How long a connection that hasn't sent a request yet may hold up shutting down")
+	fs.DurationVar(&idleTimeout, "idle-timeout", 15*time.Second, "How long an idle keep-alive connection is kept open")
+	fs.IntVar(&degradedStatus, "degraded-status", 0, "Status of the home page while Redis isn't connected, with X-Degraded: true (0 for a plain 200)")
+	fs.BoolVar(&conditionalGet, "conditional-get", false, "Send Last-Modified and honour If-Modified-Since on the home page, unless it shows the visit count")
+	fs.DurationVar(&preShutdownDelay, "pre-shutdown-delay", 0, "How long to keep serving while reporting not ready before shutting down")
+	fs.BoolVar(&pusherEnabled, "pusher", false, "Push new items onto the Redis stack on a random cycle")
+	fs.DurationVar(&pusherStaleness, "pusher-staleness", time.Minute, "Report not ready if the pusher hasn't succeeded for this long")
+	fs.IntVar(&pusherBatch, "pusher-batch", 1, "Items the pusher pushes each cycle")
+	fs.DurationVar(&pusherIntervalMin, "pusher-interval-min", time.Second, "Shortest wait between pusher cycles")
+	fs.DurationVar(&pusherIntervalMax, "pusher-interval-max", 10*time.Second, "Longest wait between pusher cycles")
+	fs.StringVar(&stackKey, "stack-key", "stack", "Redis key of the stack")
+	fs.Int64Var(&stackMaxLen, "stack-max-len", 1000, "Maximum number of items kept on the stack")
+	fs.Int64Var(&stackReadMax, "stack-read-max", 100, "Most items GET /stack returns, whatever ?limit asks for")
+	fs.IntVar(&maxBatch, "max-batch", 100, "Most items POST /stack/push-batch takes at once")
+}
+
+// cleanBasePath makes -base-path start with a slash and not end with one,
+// "" being the root
+func cleanBasePath(p string) string {
+	p = strings.TrimRight(p, "/")
+	if p != "" && !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// headers hidden from /whoami unless running with -debug
+var sensitiveHeaders = []string{"Authorization", "Cookie"}
+
 // this pushes new items onto a stack on a random cycle
 func main() {
-	flag.StringVar(&listenAddr, "binding", "0.0.0.0:5000", "Server listen address")
-	flag.StringVar(&redisAddr, "redis", "redis:6379", "Redis address (not required)")
+	registerFlags(flag.CommandLine)
 	flag.Parse()
 
-	cancel := make(chan os.Signal)
-	signal.Notify(cancel, os.Interrupt, syscall.SIGTERM)
+	logger := newLogger()
+	if err := loadConfig(flag.CommandLine); err != nil {
+		logger.Fatalf("Could not load config: %v\n", err)
+	}
+	// -log-format may have come from the environment or config file
+	logger = newLogger()
+
+	basePath = cleanBasePath(basePath)
 
-	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
+	if err := validateFlags(); err != nil {
+		logger.Fatalf("Can't start with these settings: %v\n", err)
+	}
+	stopProfile := func() {}
+	if startupProfilePath != "" {
+		var err error
+		if stopProfile, err = startupProfile(startupProfilePath, startupProfileFor, logger); err != nil {
+			logger.Fatalf("Could not start -startup-profile: %v\n", err)
+		}
+	}
+	var err error
+	if trustedProxies, err = parseNetworks(trustedProxyList); err != nil {
+		logger.Fatalf("Invalid -trusted-proxies: %v\n", err)
+	}
+	var metricsAllowed []*net.IPNet
+	if metricsAllowed, err = parseNetworks(metricsAllowList); err != nil {
+		logger.Fatalf("Invalid -metrics-allow-cidr: %v\n", err)
+	}
+	if !noRedis {
+		setRedis(newRedisClient(redisAddr))
+	}
+
+	if check {
+		if err := selfCheck(logger); err != nil {
+			logger.Fatalf("Self-test failed: %v\n", err)
+		}
+		logger.Println("Self-test passed")
+		return
+	}
+
+	if err := checkTemplate(); err != nil {
+		if !templateFallback {
+			logger.Fatalf("Could not use the home page template: %v\n", err)
+		}
+		logger.Printf("Could not use the home page template, serving the built-in page until it is fixed: %v\n", err)
+	}
+
+	if showBanner {
+		logger.Print(banner())
+	}
 	logger.Printf("Server is starting on %s...\n", listenAddr)
-	logger.Printf("Checking Redis on %s...\n", redisAddr)
+	procs, source := setMaxProcs(maxProcs)
+	logger.Printf("Using %d CPUs (%s)\n", procs, source)
+	if !noRedis {
+		logger.Printf("Checking Redis on %s...\n", redisAddr)
+		// shared with requests, so any that come in before a slow PING
+		// answers wait for it rather than sending their own
+		client := currentRedis()
+		warmup := redisPings.DoChan(client.Options().Addr, func() (interface{}, error) {
+			return nil, checkRedis(client)
+		})
+		select {
+		case result := <-warmup:
+			switch redisStatusOf(result.Err) {
+			case redisStatusConnected:
+				logger.Printf("Redis on %s is reachable\n", redisAddr)
+			case redisStatusAuthFailed:
+				logger.Printf("Redis on %s refused to let us in, starting without it: %v\n", redisAddr, result.Err)
+			case redisStatusNotRedis:
+				logger.Printf("The endpoint at %s does not speak the Redis protocol, check -redis points at Redis, starting without it: %v\n", redisAddr, result.Err)
+			default:
+				logger.Printf("Redis on %s is not reachable, starting without it\n", redisAddr)
+			}
+		case <-time.After(redisWarmupTimeout):
+			logger.Printf("Redis on %s hasn't answered after %s, starting without it\n", redisAddr, redisWarmupTimeout)
+		}
+		expvar.Publish("redis_connected", expvar.Func(func() interface{} {
+			return atomic.LoadInt32(&redisConnected) == 1
+		}))
+		expvar.Publish("redis_state", expvar.Func(func() interface{} {
+			return redisStats.snapshot()
+		}))
+	}
+
+	expvar.Publish("requests_in_flight", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&inFlight)
+	}))
+	expvar.Publish("readiness_failures", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&readinessFailures)
+	}))
 
-	router := http.NewServeMux()
-	router.Handle("/style.css", http.FileServer(http.Dir("./static")))
-	router.Handle("/background.jpg", http.FileServer(http.Dir("./static")))
-	router.HandleFunc("/", handler)
+	backend, err := newMetricsBackend(metricsBackendKind, statsdAddr, statsdPrefix)
+	if err != nil {
+		logger.Fatalf("Could not set up -metrics-backend %s: %v\n", metricsBackendKind, err)
+	}
+
+	var p *pusher
+	stopBackground := make(chan struct{})
+	if metricsBackendKind != "none" {
+		go reportGauges(backend, 10*time.Second, stopBackground)
+	}
+	if !noRedis && redisCheckInterval > 0 {
+		go watchRedis(redisCheckInterval, redisLogWindow, stopBackground, logger)
+	}
+	if pusherEnabled {
+		p = newPusher(pusherOptions{
+			key:         redisKey(stackKey),
+			maxLen:      stackMaxLen,
+			batch:       pusherBatch,
+			intervalMin: pusherIntervalMin,
+			intervalMax: pusherIntervalMax,
+		}, logger)
+		p.publishMetrics()
+		go p.run(stopBackground)
+		logger.Printf("Pushing onto %s on %s\n", redisKey(stackKey), redisAddr)
+	}
+
+	quit := make(chan os.Signal, 1)
 
-	nextRequestID := func() string {
-		return fmt.Sprintf("%d", time.Now().UnixNano())
+	var auditLog *log.Logger
+	var auditFile *os.File
+	if auditLogPath != "" {
+		if auditFile, err = openAuditLog(auditLogPath); err != nil {
+			logger.Fatalf("Could not open audit log: %v\n", err)
+		}
+		auditLog = log.New(auditFile, "", 0)
+		logger.Printf("Writing audit log to %s\n", auditLogPath)
 	}
 
+	conns := newConnTracker()
 	server := &http.Server{
 		Addr:         listenAddr,
-		Handler:      tracing(nextRequestID)(logging(logger)(router)),
+		Handler:      newHandler(newRouter(p, metricsAllowed, quit), backend, logger, auditLog),
 		ErrorLog:     logger,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+		ConnState:    conns.track,
+		IdleTimeout:  idleTimeout,
+	}
+	if h2cEnabled {
+		if err := serveH2C(server, conns); err != nil {
+			logger.Fatalf("Could not set up h2c: %v\n", err)
+		}
+	}
+	if !keepAlives {
+		server.SetKeepAlivesEnabled(false)
 	}
 
 	done := make(chan bool)
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, shutdownSignals...)
 
+	// Notify with no signals would relay all of them, and Windows has none
+	// for these two
+	reload := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(reload, reloadSignals...)
+	}
 	go func() {
-		<-quit
-		logger.Println("Server is shutting down...")
-		atomic.StoreInt32(&healthy, 0)
+		for range reload {
+			handleReload(logger)
+		}
+	}()
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
+	if quitDump && len(dumpSignals) == 0 {
+		logger.Println("Ignoring -sigquit-dump, there is no SIGQUIT on this platform")
+	} else if quitDump {
+		dump := make(chan os.Signal, 1)
+		signal.Notify(dump, dumpSignals...)
+		go func() {
+			for range dump {
+				logger.Printf("SIGQUIT, goroutine dump:\n%s", allStacks())
+			}
+		}()
+	}
 
-		server.SetKeepAlivesEnabled(false)
-		if err := server.Shutdown(ctx); err != nil {
-			logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+	go func() {
+		<-quit
+		if err := shutdownServer(server, conns, stopBackground, logger); err != nil {
+			logger.Fatalln(err)
 		}
 		close(done)
 	}()
 
+	listener, err := systemdListener()
+	if listener != nil {
+		listenAddr = listener.Addr().String()
+		logger.Printf("Using the socket passed by systemd on %s, ignoring -binding\n", listenAddr)
+	} else if err == nil {
+		listener, err = listen(listenAddr, reusePort, logger)
+	}
+	if err != nil {
+		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+	}
 	logger.Println("Server is ready to handle requests at", listenAddr)
 	atomic.StoreInt32(&healthy, 1)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
 	}
 
 	<-done
+	stopProfile()
+	if auditFile != nil {
+		auditFile.Sync()
+		auditFile.Close()
+	}
 	logger.Println("Server stopped")
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	var contentBytes, _ = ioutil.ReadFile("./static/index.html")
-	var content = string(contentBytes)
-	var leadContent string
-	if testRedisConnection(redisAddr) {
-		leadContent = "This is a simple service application(connected to Redis). Deployed by Cloud 66 ~"
+// serveH2C has server take HTTP/2 over cleartext too. Those connections
+// are hijacked out of server, so Shutdown only sends them a GOAWAY and conns
+// is what shutdownServer waits on for their requests to finish
+func serveH2C(server *http.Server, conns *connTracker) error {
+	h2s := &http2.Server{IdleTimeout: idleTimeout}
+	server.Handler = conns.countRunning(h2c.NewHandler(server.Handler, h2s))
+	return http2.ConfigureServer(server, h2s)
+}
+
+// handleReload is what SIGHUP does: re-read the config file and the template
+func handleReload(logger *log.Logger) {
+	logger.Println("Reloading...")
+	reloadConfig(flag.CommandLine, logger)
+	if err := checkTemplate(); err != nil {
+		logger.Printf("Template problem: %v\n", err)
+	}
+}
+
+// shutdownServer is what happens once we're told to quit: stop being
+// ready, stop the background work, then stop accepting connections and
+// wait up to -shutdown-timeout for the requests in flight to finish
+func shutdownServer(server *http.Server, conns *connTracker, stopBackground chan struct{}, logger *log.Logger) error {
+	drainStart, servedBefore := time.Now(), atomic.LoadInt64(&served)
+	logger.Println("Server is shutting down...")
+	atomic.StoreInt32(&healthy, 0)
+	close(stopBackground)
+
+	// give load balancers time to notice we're not ready and stop
+	// sending traffic before we stop accepting it
+	if preShutdownDelay > 0 {
+		logger.Printf("Waiting %s before shutting down...\n", preShutdownDelay)
+		time.Sleep(preShutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Shutdown closes idle keep-alive connections straight away, and
+	// active ones as soon as their request is done. It leaves ones that
+	// haven't sent a request yet until they are 5s old, these don't get
+	// that long
+	counts := conns.count()
+	logger.Printf("Closing %d idle connections, waiting on %d active and %d that haven't sent a request yet\n",
+		counts[http.StateIdle], counts[http.StateActive], counts[http.StateNew])
+	grace := time.AfterFunc(drainIdleGrace, func() {
+		if n := conns.closeIn(http.StateNew, http.StateIdle); n > 0 {
+			logger.Printf("Closed %d connections still without a request after the %s -drain-idle-grace\n", n, drainIdleGrace)
+		}
+	})
+	server.SetKeepAlivesEnabled(false)
+	err := server.Shutdown(ctx)
+	if err == nil {
+		err = conns.waitRunning(ctx)
+	}
+	grace.Stop()
+	drained := atomic.LoadInt64(&served) - servedBefore
+	if err != nil {
+		return fmt.Errorf("Could not gracefully shutdown the server within -shutdown-timeout %s, %d requests finished and %d were still in flight after %s: %v",
+			shutdownTimeout, drained, atomic.LoadInt64(&inFlight), time.Since(drainStart).Round(time.Millisecond), err)
+	}
+	logger.Printf("Drained in %s, within the %s -shutdown-timeout, %d requests finished during the drain\n", time.Since(drainStart).Round(time.Millisecond), shutdownTimeout, drained)
+	return nil
+}
+
+// patternMux is an http.ServeMux that remembers the patterns registered on
+// it, so the routes can be listed
+type patternMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *patternMux) Handle(pattern string, handler http.Handler) {
+	m.ServeMux.Handle(pattern, handler)
+	m.patterns = append(m.patterns, pattern)
+}
+
+func (m *patternMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// newRouter registers every route, as the flags say
+func newRouter(p *pusher, metricsAllowed []*net.IPNet, quit chan<- os.Signal) *patternMux {
+	admin := basicAuth(adminUser, adminPass)
+	static := cacheControl(cacheMaxAge)(http.StripPrefix(basePath, http.FileServer(filesOnly{http.Dir(staticDir)})))
+
+	router := &patternMux{ServeMux: http.NewServeMux()}
+	router.Handle(basePath+"/style.css", static)
+	router.Handle(basePath+"/background.jpg", static)
+	router.HandleFunc(basePath+"/favicon.ico", favicon)
+	router.Handle(basePath+"/whoami", admin(http.HandlerFunc(whoami)))
+	router.Handle(basePath+"/stack", readStack(stackReadMax))
+	router.HandleFunc(basePath+"/stack/", stackItem)
+	router.HandleFunc(basePath+"/uptime", uptime)
+	router.Handle(basePath+metricsPath, allowFrom(metricsAllowed, admin)(metricsHandler()))
+	router.Handle(basePath+"/debug/config", admin(http.HandlerFunc(debugConfig)))
+	router.HandleFunc(basePath+"/openapi.json", openAPI)
+	if remoteShutdown {
+		router.Handle(basePath+"/shutdown", admin(shutdown(quit)))
+	}
+	// destructive, so only there once it can be protected
+	if adminUser != "" {
+		router.Handle(basePath+"/stack/flush", admin(http.HandlerFunc(flushStack)))
+		router.Handle(basePath+"/stack/push-batch", admin(pushBatch(maxBatch)))
+		router.Handle(basePath+"/drain", admin(drain(true)))
+		router.Handle(basePath+"/undrain", admin(drain(false)))
+	}
+	router.Handle(basePath+"/livez", healthz(maxGoroutines))
+	router.Handle(basePath+"/readyz", readyz(p, readinessCacheTTL, readinessThreshold))
+	if disableRoot {
+		// only the page goes, the static files stay for anything that
+		// still links to them
+		router.HandleFunc(basePath+"/", notFound)
 	} else {
-		leadContent = "This is a simple single service application. Deployed by Cloud 66"
+		router.HandleFunc(basePath+"/", handler)
 	}
-	content = strings.Replace(content, "{{LEAD}}", leadContent, -1)
+	if basePath != "" && disableRoot {
+		// everything outside the base path gets the same 404 as inside it
+		router.HandleFunc("/", notFound)
+	} else if basePath != "" {
+		router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				notFound(w, r)
+				return
+			}
+			// relative, so whatever Host the client sent doesn't end up in it
+			http.Redirect(w, r, basePath+"/", http.StatusFound)
+		})
+	}
+	return router
+}
+
+// newHandler puts the middleware around router, from rate limiting on the
+// inside to recovery on the outside, so a panic anywhere is caught
+func newHandler(router *patternMux, backend metricsBackend, logger, auditLog *log.Logger) http.Handler {
+	// probes must never be rate limited nor turned away, kubelet sends the
+	// pod IP as the Host, nor refused for a strict Accept-Encoding
+	probes := map[string]bool{basePath + "/livez": true, basePath + "/readyz": true}
+	var routes http.Handler = router
+	if rateLimit > 0 {
+		var primary, fallback rateLimiter = newMemoryLimiter(rateLimit, rateLimitWindow), nil
+		if rateLimitBackend == "redis" {
+			primary, fallback = &redisLimiter{limit: rateLimit, window: rateLimitWindow}, primary
+		}
+		routes = rateLimiting(primary, fallback, rateLimitWindow, probes)(router)
+	}
+	routes = allowedHosts(parseHosts(allowedHostList), probes)(routes)
+	routes = keepAliveHint(keepAliveHeader, idleTimeout)(routes)
+	// inside trailingSlashes, so the route is looked up on the path the
+	// router gets. Its slash redirects aren't counted against any route
+	routes = trailingSlashes(slashMode)(routeMetrics(router.ServeMux, backend)(routes))
+
+	nextRequestID := requestIDGenerator(requestIDFormat)
+	return recovery(tracing(requestIDHeader, nextRequestID, hideRequestID)(requestIDTrailer(requestIDTrailers, requestIDHeader)(audit(auditLog)(logging(logger)(countInFlight(slowRequests(slowRequestThreshold)(addHeaders(http.Header(extraHeaders))(compress(gzipEnabled, gzipLevel, probes)(requestTimeout(requestTimeoutDef, requestTimeoutMax)(routes))))))))))
+}
+
+// selfCheck makes sure the server could start with the current configuration
+func selfCheck(logger *log.Logger) error {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("could not bind %s: %v", listenAddr, err)
+	}
+	listener.Close()
+	logger.Printf("Bind %s: ok\n", listenAddr)
+
+	if err := checkTemplate(); err != nil {
+		return err
+	}
+	logger.Printf("Template %s: ok\n", templatePath())
+
+	// Redis is not required so being unable to reach it is not a failure
+	if noRedis {
+		logger.Println("Redis: disabled")
+	} else if testRedisConnection(currentRedis()) {
+		logger.Printf("Redis %s: ok\n", redisAddr)
+	} else {
+		logger.Printf("Redis %s: not reachable\n", redisAddr)
+	}
+	return nil
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	// "/" matches everything the other routes don't
+	if r.URL.Path != basePath+"/" {
+		notFound(w, r)
+		return
+	}
+
+	content := templateContent()
+	// every view changes the count, a 304 would show a stale one
+	showsVisits := strings.Contains(content, "{{VISITS}}")
+	if clientGone(r, "checking Redis") {
+		return
+	}
+	state := leadStandalone
+	if noRedis {
+		debugf(r.Context(), "Redis check: skipped, running with -no-redis")
+	} else if testRedisConnectionFor(r.Context(), currentRedis()) {
+		state = leadConnected
+	} else if redisStats.currentStatus() == "" {
+		// rather than claim to be standalone before we know
+		state = leadChecking
+	}
+	if clientGone(r, "rendering") {
+		return
+	}
+	visits := countVisit(r.Context(), state == leadConnected)
+	renderStart := time.Now()
+	lang := preferredLanguage(r.Header.Get("Accept-Language"))
+	debugf(r.Context(), "Rendering the %s lead text", state)
+	leadContent := leadMessage(lang, state)
+	leadChanged := recordLead(state)
+	content = strings.Replace(content, "{{BASE}}", basePath, -1)
+	content = strings.Replace(content, "{{LANG}}", lang, -1)
+	content = strings.Replace(content, "{{LEAD}}", html.EscapeString(leadContent), -1)
+	content = strings.Replace(content, "{{TITLE}}", html.EscapeString(pageTitle), -1)
+	content = strings.Replace(content, "{{VISITS}}", strconv.FormatInt(visits, 10), -1)
+	renderDuration.observe(time.Since(renderStart))
+
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	// for synthetic monitors that only look at the status and headers
+	if degradedStatus != 0 && !noRedis && state != leadConnected {
+		w.Header().Set("X-Degraded", "true")
+		if degradedStatus != http.StatusOK {
+			w.WriteHeader(degradedStatus)
+			w.Write([]byte(content))
+			return
+		}
+	}
+	if !conditionalGet || showsVisits {
+		w.Write([]byte(content))
+		return
+	}
+
+	// the page is only as old as the newer of the template and the lead
+	// text, otherwise a Redis outage would be hidden behind a 304
+	modTime := leadChanged
+	if info, err := os.Stat(templatePath()); err == nil && info.ModTime().After(modTime) {
+		modTime = info.ModTime()
+	}
+	http.ServeContent(w, r, "index.html", modTime, strings.NewReader(content))
+}
+
+// clientGone reports whether the client has stopped waiting for the
+// response, so the handler can stop before doing the next step
+func clientGone(r *http.Request, step string) bool {
+	err := r.Context().Err()
+	if err == nil {
+		return false
+	}
+	debugf(r.Context(), "Client went away before %s: %v", step, err)
+	return true
+}
+
+var (
+	// which lead text was rendered last, a leadState, and when that changed
+	leadShown   int32
+	leadChanged int64
+)
+
+// recordLead notes which lead text is being rendered and returns when it
+// last changed. The first call counts as a change
+func recordLead(state leadState) time.Time {
+	if leadState(atomic.SwapInt32(&leadShown, int32(state))) != state || atomic.LoadInt64(&leadChanged) == 0 {
+		atomic.StoreInt64(&leadChanged, time.Now().UnixNano())
+	}
+	return time.Unix(0, atomic.LoadInt64(&leadChanged))
+}
+
+// notFound answers with JSON to clients that ask for it and with the
+// not found page to everyone else
+func notFound(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		writeJSONError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+
+	contentBytes, err := ioutil.ReadFile(staticFile("404.html"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	content := strings.Replace(string(contentBytes), "{{BASE}}", basePath, -1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte(content))
 }
 
-func healthz() http.Handler {
+// serverError answers with static/500.html and the request ID to quote,
+// or as plain text when there is no such page. JSON clients get the usual
+// JSON error
+func serverError(w http.ResponseWriter, r *http.Request, code int) {
+	requestID := requestIDFrom(r.Context())
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		writeJSONError(w, r, code, "internal error")
+		return
+	}
+
+	contentBytes, err := ioutil.ReadFile(staticFile("500.html"))
+	if err != nil {
+		http.Error(w, "Internal error, reference: "+requestID, code)
+		return
+	}
+	content := strings.Replace(string(contentBytes), "{{BASE}}", basePath, -1)
+	content = strings.Replace(content, "{{REQUEST_ID}}", html.EscapeString(requestID), -1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write([]byte(content))
+}
+
+// openAPI serves the API description with the base path as its server
+func openAPI(w http.ResponseWriter, r *http.Request) {
+	contentBytes, err := ioutil.ReadFile(staticFile("openapi.json"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(contentBytes, &spec); err != nil {
+		requestLogger(r.Context()).Printf("Could not parse %s: %v\n", staticFile("openapi.json"), err)
+		writeJSONError(w, r, http.StatusInternalServerError, "invalid API description")
+		return
+	}
+	server := basePath
+	if server == "" {
+		server = "/"
+	}
+	spec["servers"] = []map[string]string{{"url": server}}
+	if paths, ok := spec["paths"].(map[string]interface{}); ok && metricsPath != "/metrics" {
+		paths[metricsPath] = paths["/metrics"]
+		delete(paths, "/metrics")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(spec)
+}
+
+// debugConfig shows the configuration in effect, with secrets redacted
+func debugConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(effectiveConfig())
+}
+
+// whoami echoes back what the server saw of the request, which is handy
+// for finding out what a proxy or load balancer added or stripped
+func whoami(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	headers := r.Header.Clone()
+	headers.Set("Host", r.Host)
+	if !debugMode {
+		for _, name := range sensitiveHeaders {
+			if headers.Get(name) != "" {
+				headers.Set(name, "[redacted]")
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ClientIP  string      `json:"client_ip"`
+		Scheme    string      `json:"scheme"`
+		Method    string      `json:"method"`
+		Path      string      `json:"path"`
+		RequestID string      `json:"request_id"`
+		Headers   http.Header `json:"headers"`
+	}{
+		ClientIP:  clientIP(r),
+		Scheme:    requestScheme(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		RequestID: requestIDFrom(r.Context()),
+		Headers:   headers,
+	})
+}
+
+// writeJSONError is how the JSON routes report errors, so clients always get
+// the same envelope and a request ID to quote back to us
+func writeJSONError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{
+		Error:     msg,
+		RequestID: requestIDFrom(r.Context()),
+	})
+}
+
+// shutdown starts the same graceful shutdown as SIGTERM. The response goes
+// out before the server stops since shutting down waits for it
+func shutdown(quit chan<- os.Signal) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if atomic.LoadInt32(&healthy) == 1 {
-			w.WriteHeader(http.StatusNoContent)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
 			return
 		}
-		w.WriteHeader(http.StatusServiceUnavailable)
+		requestLogger(r.Context()).Println("Shutdown requested by", clientIP(r))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"shutting down"}` + "\n"))
+
+		// if a shutdown is already pending there is nothing to add
+		select {
+		case quit <- syscall.SIGTERM:
+		default:
+		}
 	})
 }
 
-func testRedisConnection(redisAddress string) bool {
-	client := redis.NewClient(&redis.Options{
-		Addr:     redisAddress,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	pong, _ := client.Ping().Result()
-	if pong == "PONG" {
-		return true
+// responseWriter remembers the status code and size of the response
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// finalStatus is the status to record for the response. One that panicked
+// before writing anything is answered with a 500 by recovery, further out
+func (rw *responseWriter) finalStatus(panicked bool) int {
+	if panicked && !rw.wroteHeader {
+		return http.StatusInternalServerError
+	}
+	return rw.status
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.status = code
+		rw.wroteHeader = true
 	}
-	return false
-	// Output: PONG <nil>
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom is what http.ServeContent ends up calling for static files, so
+// the server can sendfile them instead of copying through a buffer
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rw.wroteHeader = true
+	n, err := readFrom(rw.ResponseWriter, src)
+	rw.bytes += n
+	return n, err
+}
+
+// writerOnly hides any ReadFrom, so io.Copy falls back to plain writes
+type writerOnly struct {
+	io.Writer
+}
+
+// readFrom copies src to w, letting w take it in one go when it can and
+// -sendfile is on
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok && sendfile {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{w}, src)
+}
+
+// Flush and Hijack pass through so streaming and websocket handlers still
+// work behind the middleware
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T can't be hijacked", rw.ResponseWriter)
+	}
+	rw.wroteHeader = true
+	rw.status = http.StatusSwitchingProtocols
+	return h.Hijack()
 }
 
 func logging(logger *log.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			requestID := truncate(requestIDFrom(r.Context()), logMaxRequestID)
+			panicked := true
 			defer func() {
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
+				status := rw.finalStatus(panicked)
+				// errors are always logged, successes only as often as
+				// -log-sample-rate says, and nothing below 400 with
+				// -log-errors-only
+				success := status >= 200 && status < 300
+				if success && logSampleRate < 1 && rand.Float64() >= logSampleRate {
+					return
+				}
+				if logErrorsOnly && status < 400 {
+					return
+				}
+				duration := time.Since(start)
+				if lw, ok := logger.Writer().(*logfmtWriter); ok {
+					lw.writePairs(strings.Join([]string{
+						logfmtPair("msg", "request"),
+						logfmtPair("request_id", requestID),
+						logfmtPair("method", r.Method),
+						logfmtPair("path", r.URL.Path),
+						logfmtPair("remote_addr", r.RemoteAddr),
+						logfmtPair("user_agent", truncate(r.UserAgent(), logMaxUserAgent)),
+						logfmtPair("duration", duration.String()),
+						logfmtPair("latency_bucket", latencyBucket(duration)),
+						logfmtPair("status", strconv.Itoa(status)),
+						logfmtPair("bytes", strconv.FormatInt(rw.bytes, 10)),
+					}, " "))
+					return
 				}
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, truncate(r.UserAgent(), logMaxUserAgent), duration, "latency_bucket="+latencyBucket(duration), "status="+strconv.Itoa(status), "bytes="+strconv.FormatInt(rw.bytes, 10))
 			}()
+
+			requestLog := log.New(logger.Writer(), logger.Prefix()+requestID+" ", logger.Flags())
+			if lw, ok := logger.Writer().(*logfmtWriter); ok {
+				requestLog = log.New(lw.with("request_id", requestID), "", 0)
+			}
+			ctx := context.WithValue(r.Context(), loggerKey, requestLog)
+			if inner, ok := ctx.Value(recoveryKey).(*requestContext); ok {
+				inner.ctx = ctx
+			}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+			panicked = false
+		})
+	}
+}
+
+// requestContext is where logging leaves the request's context, with its
+// ID and logger, for recovery further out to report a panic against
+type requestContext struct {
+	ctx context.Context
+}
+
+// recovery turns a panic into a 500. The stack trace is only logged, the
+// client gets the request ID to quote back to us. Once the response has
+// started there is nothing to do but log it
+func recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner := &requestContext{ctx: r.Context()}
+		r = r.WithContext(context.WithValue(r.Context(), recoveryKey, inner))
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// the server uses this one to abort a response on purpose
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			requestLogger(inner.ctx).Printf("Panic: %v\n%s", err, debug.Stack())
+			if !rw.wroteHeader {
+				serverError(w, r.WithContext(inner.ctx), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// basicAuth protects the admin endpoints. With no user configured it lets
+// everything through
+func basicAuth(user, pass string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if user == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			u, p, ok := r.BasicAuth()
+			userMatch := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+			passMatch := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+			if !ok || !userMatch || !passMatch {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowFrom skips auth for connections straight from one of nets. It looks
+// at the peer address only, X-Forwarded-For can't be used to get in
+func allowFrom(nets []*net.IPNet, auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		protected := auth(next)
+		if len(nets) == 0 {
+			return protected
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := peerIP(r); ip != nil && inNetworks(ip, nets) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			protected.ServeHTTP(w, r)
+		})
+	}
+}
+
+var (
+	// requests being handled right now, published as requests_in_flight
+	inFlight int64
+	// requests finished since startup
+	served int64
+)
+
+// countInFlight keeps inFlight and served up to date. The decrement is
+// deferred so a panicking handler still gives its slot back
+func countInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		defer func() {
+			atomic.AddInt64(&inFlight, -1)
+			atomic.AddInt64(&served, 1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// latencyBucket puts a request duration into a coarse category so slow
+// requests can be counted from the logs alone
+func latencyBucket(d time.Duration) string {
+	switch {
+	case d < 50*time.Millisecond:
+		return "fast"
+	case d < 250*time.Millisecond:
+		return "normal"
+	case d < time.Second:
+		return "slow"
+	default:
+		return "very_slow"
+	}
+}
+
+// requestIDFrom returns the request ID set by tracing
+func requestIDFrom(ctx context.Context) string {
+	requestID, ok := ctx.Value(requestIDKey).(string)
+	if !ok {
+		return "unknown"
+	}
+	return requestID
+}
+
+// requestLogger returns the logger set up by logging for this request, which
+// tags every line with the request ID
+func requestLogger(ctx context.Context) *log.Logger {
+	requestLog, ok := ctx.Value(loggerKey).(*log.Logger)
+	if !ok {
+		return newLogger()
+	}
+	return requestLog
+}
+
+// debugf logs against the request only when running with -debug
+func debugf(ctx context.Context, format string, v ...interface{}) {
+	if debugMode {
+		requestLogger(ctx).Printf("DEBUG "+format+"\n", v...)
+	}
+}
+
+// requestIDTrailer repeats the request ID header as a trailer, for
+// streaming clients that only look at the end of the response. Trailers
+// only go out on chunked responses, ones with a Content-Length are unchanged
+func requestIDTrailer(enabled bool, header string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Trailer", header)
 			next.ServeHTTP(w, r)
+			w.Header().Set(header, requestIDFrom(r.Context()))
 		})
 	}
 }
 
-func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
+// tracing gives every request an ID, the client's own in header when it
+// sent a usable one. It is sent back in the same header unless hide is set
+func tracing(header string, nextRequestID func() string, hide bool) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestID := r.Header.Get("X-Request-Id")
-			if requestID == "" {
+			requestID := strings.TrimSpace(r.Header.Get(header))
+			if !validRequestID(requestID) {
 				requestID = nextRequestID()
 			}
 			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-			w.Header().Set("X-Request-Id", requestID)
+			if !hide {
+				w.Header().Set(header, requestID)
+			}
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
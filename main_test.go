@@ -0,0 +1,898 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// testServer is the whole server, every route behind the middleware chain
+// main builds, listening on a random port. URL is where it is
+type testServer struct {
+	*httptest.Server
+	quit chan os.Signal
+	logs *syncBuffer
+}
+
+// startTestServer starts a server with the flags in args on top of the
+// defaults. It runs with -no-redis unless args say otherwise. Close it
+// when done
+func startTestServer(t testing.TB, args ...string) *testServer {
+	t.Helper()
+	return startTestRouter(t, nil, args...)
+}
+
+// startTestRouter is startTestServer with extra routes, like ones that
+// panic
+func startTestRouter(t testing.TB, routes map[string]http.HandlerFunc, args ...string) *testServer {
+	t.Helper()
+	setTestFlags(t, args...)
+	logs := &syncBuffer{}
+	quit := make(chan os.Signal, 1)
+	router := newRouter(nil, nil, quit)
+	for pattern, route := range routes {
+		router.HandleFunc(pattern, route)
+	}
+	handler := newHandler(router, noMetrics{}, log.New(logs, "http: ", log.LstdFlags), nil)
+	return &testServer{Server: httptest.NewServer(handler), quit: quit, logs: logs}
+}
+
+func (s *testServer) Close() {
+	s.Server.Close()
+	setRedis(nil)
+}
+
+// get is a GET of path on the server, with headers as "Name", "value"
+// pairs. The body is read and closed
+func (s *testServer) get(t testing.TB, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	return s.do(t, http.MethodGet, path, headers...)
+}
+
+func (s *testServer) do(t testing.TB, method, path string, headers ...string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if strings.EqualFold(headers[i], "Host") {
+			req.Host = headers[i+1]
+			continue
+		}
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the body: %v", method, path, err)
+	}
+	return res, string(body)
+}
+
+// setTestFlags puts every flag back to its default, then applies args the
+// way main would. The state main sets up from them is reset too
+func setTestFlags(t testing.TB, args ...string) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	if err := fs.Parse(append([]string{"-no-redis"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	basePath = cleanBasePath(basePath)
+
+	atomic.StoreInt32(&healthy, 1)
+	atomic.StoreInt32(&drained, 0)
+	atomic.StoreInt32(&redisConnected, 0)
+	atomic.StoreInt64(&readinessFailures, 0)
+	redisStats = redisStateStats{}
+	if noRedis {
+		setRedis(nil)
+	} else {
+		setRedis(newRedisClient(redisAddr))
+	}
+	currentTemplate.Store((*loadedTemplate)(nil))
+	if err := checkTemplate(); err != nil && !templateFallback {
+		t.Fatal(err)
+	}
+}
+
+// syncBuffer is a log destination that can be read while being written
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// fakeRedis speaks just enough RESP for the app: PING, INCR, list lengths
+// for LPUSH, LLEN and LTRIM, MULTI/EXEC, and +OK to anything else. Every
+// PING, and the command in slowOn, waits delay before it is answered, and
+// the connection is dropped without a reply on the command in hangUpOn
+type fakeRedis struct {
+	ln       net.Listener
+	delay    time.Duration
+	pings    int64
+	hangUpOn string
+	slowOn   string
+
+	mu       sync.Mutex
+	counts   map[string]int64
+	lengths  map[string]int64
+	commands map[string]int
+	conns    map[net.Conn]bool
+}
+
+func startFakeRedis(t testing.TB, delay time.Duration) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, delay: delay, counts: map[string]int64{}, lengths: map[string]int64{}, commands: map[string]int{}, conns: map[net.Conn]bool{}}
+	go f.accept(ln)
+	return f
+}
+
+func (f *fakeRedis) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		go f.serve(conn)
+	}
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.ln.Close()
+}
+
+// down drops every connection and stops listening, like Redis going away
+func (f *fakeRedis) down() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// up listens again on the address it had before down
+func (f *fakeRedis) up(t testing.TB) {
+	t.Helper()
+	ln, err := net.Listen("tcp", f.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ln = ln
+	go f.accept(ln)
+}
+
+func (f *fakeRedis) pinged() int64 {
+	return atomic.LoadInt64(&f.pings)
+}
+
+// received is how many times name was sent
+func (f *fakeRedis) received(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commands[name]
+}
+
+// count is where INCR has got key to
+func (f *fakeRedis) count(key string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[key]
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	// replies held back between MULTI and EXEC, nil outside a transaction
+	var queued []string
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		f.mu.Lock()
+		f.commands[name]++
+		f.mu.Unlock()
+		if name == f.hangUpOn {
+			return
+		}
+		if name == f.slowOn {
+			time.Sleep(f.delay)
+		}
+		switch {
+		case name == "MULTI":
+			queued = []string{}
+			io.WriteString(conn, "+OK\r\n")
+		case name == "EXEC":
+			fmt.Fprintf(conn, "*%d\r\n%s", len(queued), strings.Join(queued, ""))
+			queued = nil
+		case queued != nil:
+			queued = append(queued, f.reply(args))
+			io.WriteString(conn, "+QUEUED\r\n")
+		case name == "PING":
+			time.Sleep(f.delay)
+			atomic.AddInt64(&f.pings, 1)
+			io.WriteString(conn, "+PONG\r\n")
+		default:
+			io.WriteString(conn, f.reply(args))
+		}
+	}
+}
+
+// reply is what Redis would answer to args, as far as the fake knows
+func (f *fakeRedis) reply(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "INCR":
+		f.counts[args[1]]++
+		return fmt.Sprintf(":%d\r\n", f.counts[args[1]])
+	case "LPUSH":
+		f.lengths[args[1]] += int64(len(args) - 2)
+		return fmt.Sprintf(":%d\r\n", f.lengths[args[1]])
+	case "LLEN":
+		return fmt.Sprintf(":%d\r\n", f.lengths[args[1]])
+	case "LTRIM":
+		if stop, err := strconv.ParseInt(args[3], 10, 64); err == nil && stop >= 0 && f.lengths[args[1]] > stop+1 {
+			f.lengths[args[1]] = stop + 1
+		}
+	case "PING":
+		return "+PONG\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// readCommand reads one command sent as a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad array length in %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad bulk string length in %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func TestServerStarts(t *testing.T) {
+	s := startTestServer(t)
+	defer s.Close()
+
+	res, _ := s.get(t, "/uptime")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("/uptime: got %d, want 200", res.StatusCode)
+	}
+	if res.Header.Get("X-Request-Id") == "" {
+		t.Error("no X-Request-Id, the middleware chain isn't in front of the router")
+	}
+}
+
+func TestServerWithFakeRedis(t *testing.T) {
+	redis := startFakeRedis(t, 0)
+	defer redis.close()
+	s := startTestServer(t, "-no-redis=false", "-redis", redis.addr())
+	defer s.Close()
+
+	res, _ := s.get(t, "/")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("/: got %d, want 200", res.StatusCode)
+	}
+	if n := redis.count(redisKey("visits")); n != 1 {
+		t.Errorf("the visit wasn't counted in Redis, INCR %s is at %d", redisKey("visits"), n)
+	}
+	if redis.pinged() == 0 {
+		t.Error("the home page didn't check Redis")
+	}
+}
+
+func TestBasePathRedirectIsRelative(t *testing.T) {
+	s := startTestServer(t, "-base-path", "/app")
+	defer s.Close()
+
+	res, _ := s.get(t, "/", "Host", "evil.example")
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("got %d, want 302", res.StatusCode)
+	}
+	if got := res.Header.Get("Location"); got != "/app/" {
+		t.Errorf("Location is %q, want /app/ without the client's Host", got)
+	}
+}
+
+func panics(w http.ResponseWriter, r *http.Request) {
+	panic("boom")
+}
+
+// recovery has to be outside everything else, and tracing and logging have
+// to have run by the time it reports the panic
+func TestMiddlewareOrder(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"-gzip"},
+		{"-request-id-trailer"},
+		{"-audit-log", os.DevNull},
+		{"-request-timeout", "1s"},
+		{"-log-format", "logfmt"},
+	} {
+		s := startTestRouter(t, map[string]http.HandlerFunc{"/boom": panics}, args...)
+		res, body := s.get(t, "/boom", "Accept-Encoding", "gzip")
+		s.Close()
+
+		if res.StatusCode != http.StatusInternalServerError {
+			t.Errorf("%v: got %d, want 500", args, res.StatusCode)
+			continue
+		}
+		id := res.Header.Get("X-Request-Id")
+		if id == "" {
+			t.Errorf("%v: no X-Request-Id on the 500", args)
+			continue
+		}
+		if !strings.Contains(body, id) {
+			t.Errorf("%v: the 500 page doesn't have the request ID %s:\n%s", args, id, body)
+		}
+		logs := s.logs.String()
+		if !strings.Contains(logs, "Panic: boom") || !strings.Contains(logs, ".panics(") {
+			t.Errorf("%v: the panic and its stack weren't logged:\n%s", args, logs)
+		}
+		for _, line := range strings.Split(logs, "\n") {
+			if strings.Contains(line, "Panic: boom") && !strings.Contains(line, id) {
+				t.Errorf("%v: the panic was logged without the request ID %s: %s", args, id, line)
+			}
+			if strings.Contains(line, "/boom") && !strings.Contains(line, "status=500") {
+				t.Errorf("%v: the access log doesn't say 500: %s", args, line)
+			}
+		}
+	}
+}
+
+// panicOnce panics on its first write, like a broken log destination
+type panicOnce struct {
+	syncBuffer
+	done int32
+}
+
+func (w *panicOnce) Write(p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&w.done, 0, 1) {
+		panic("log write failed")
+	}
+	return w.syncBuffer.Write(p)
+}
+
+func TestErrorPage(t *testing.T) {
+	// a static directory with the page template but no 500.html
+	bare, err := ioutil.TempDir("", "helloworld-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bare)
+	index, err := ioutil.ReadFile(filepath.Join("static", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bare, "index.html"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		args        []string
+		accept      string
+		contentType string
+		page        string
+	}{
+		{"page", nil, "text/html", "text/html; charset=utf-8", "<title>Something went wrong</title>"},
+		{"no page", []string{"-static-dir", bare}, "text/html", "text/plain; charset=utf-8", "Internal error, reference: "},
+		{"json", nil, "application/json", "application/json", `"internal error"`},
+	}
+	for _, tt := range tests {
+		s := startTestRouter(t, map[string]http.HandlerFunc{"/boom": panics}, tt.args...)
+		res, body := s.get(t, "/boom", "Accept", tt.accept)
+		s.Close()
+
+		if res.StatusCode != http.StatusInternalServerError {
+			t.Errorf("%s: got %d, want 500", tt.name, res.StatusCode)
+		}
+		if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("%s: Content-Type is %q, want %s", tt.name, got, tt.contentType)
+		}
+		if !strings.Contains(body, tt.page) {
+			t.Errorf("%s: the body doesn't have %q:\n%s", tt.name, tt.page, body)
+		}
+		if id := res.Header.Get("X-Request-Id"); id == "" || !strings.Contains(body, id) {
+			t.Errorf("%s: the body doesn't have the request ID %s:\n%s", tt.name, id, body)
+		}
+	}
+}
+
+func TestRecoveryCatchesMiddlewarePanics(t *testing.T) {
+	setTestFlags(t)
+	defer setRedis(nil)
+	logs := &panicOnce{}
+	s := httptest.NewServer(newHandler(newRouter(nil, nil, nil), noMetrics{}, log.New(logs, "http: ", log.LstdFlags), nil))
+	defer s.Close()
+
+	// the access log line panics once the page is written, net/http
+	// would drop the connection if that got to it
+	res, err := http.Get(s.URL + "/uptime")
+	if err != nil {
+		t.Fatalf("the panic in logging wasn't caught: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want the 200 that was already written", res.StatusCode)
+	}
+	if !strings.Contains(logs.String(), "Panic: log write failed") {
+		t.Errorf("the panic wasn't logged:\n%s", logs.String())
+	}
+}
+
+func TestConditionalGetWithVisits(t *testing.T) {
+	s := startTestServer(t, "-conditional-get")
+	defer s.Close()
+
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	var last string
+	for i := 0; i < 2; i++ {
+		res, body := s.get(t, "/", "If-Modified-Since", later)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got %d, the page shows the visit count so it is never a 304", res.StatusCode)
+		}
+		if res.Header.Get("Last-Modified") != "" {
+			t.Errorf("Last-Modified sent on a page with the visit count")
+		}
+		if body == last {
+			t.Errorf("the visit count didn't change between views")
+		}
+		last = body
+	}
+}
+
+func TestConditionalGetWithoutVisits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	page := "<html><body>{{LEAD}}</body></html>\n"
+	if err := ioutil.WriteFile(dir+"/index.html", []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startTestServer(t, "-conditional-get", "-static-dir", dir)
+	defer s.Close()
+
+	res, _ := s.get(t, "/")
+	modified := res.Header.Get("Last-Modified")
+	if res.StatusCode != http.StatusOK || modified == "" {
+		t.Fatalf("got %d with Last-Modified %q, want a 200 with one", res.StatusCode, modified)
+	}
+	if res, _ = s.get(t, "/", "If-Modified-Since", modified); res.StatusCode != http.StatusNotModified {
+		t.Errorf("got %d, want 304", res.StatusCode)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	basic := func(user, pass string) string {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(user, pass)
+		return req.Header.Get("Authorization")
+	}
+	tests := []struct {
+		name          string
+		args          []string
+		authorization string
+		status        int
+	}{
+		{"correct", []string{"-admin-user", "admin", "-admin-pass", "secret"}, basic("admin", "secret"), http.StatusOK},
+		{"missing", []string{"-admin-user", "admin", "-admin-pass", "secret"}, "", http.StatusUnauthorized},
+		{"wrong user", []string{"-admin-user", "admin", "-admin-pass", "secret"}, basic("root", "secret"), http.StatusUnauthorized},
+		{"wrong password", []string{"-admin-user", "admin", "-admin-pass", "secret"}, basic("admin", "guess"), http.StatusUnauthorized},
+		{"not basic", []string{"-admin-user", "admin", "-admin-pass", "secret"}, "Bearer secret", http.StatusUnauthorized},
+		{"disabled", nil, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		s := startTestServer(t, tt.args...)
+		res, _ := s.get(t, "/whoami", "Authorization", tt.authorization)
+		public, _ := s.get(t, "/uptime")
+		s.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+		challenge := res.Header.Get("WWW-Authenticate")
+		if tt.status == http.StatusUnauthorized && !strings.HasPrefix(challenge, "Basic ") {
+			t.Errorf("%s: the 401 has no Basic challenge, WWW-Authenticate is %q", tt.name, challenge)
+		}
+		if public.StatusCode != http.StatusOK {
+			t.Errorf("%s: public /uptime got %d, want 200 without credentials", tt.name, public.StatusCode)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	tests := []struct {
+		args   []string
+		path   string
+		status int
+	}{
+		{nil, "/", http.StatusOK},
+		{nil, "/foo", http.StatusNotFound},
+		{nil, "/foo/bar", http.StatusNotFound},
+		{[]string{"-base-path", "/app"}, "/app/", http.StatusOK},
+		{[]string{"-base-path", "/app"}, "/app/foo", http.StatusNotFound},
+		{[]string{"-base-path", "/app"}, "/foo", http.StatusNotFound},
+		{[]string{"-disable-root"}, "/", http.StatusNotFound},
+		{[]string{"-disable-root", "-base-path", "/app"}, "/", http.StatusNotFound},
+		{[]string{"-disable-root", "-base-path", "/app"}, "/app/", http.StatusNotFound},
+		{[]string{"-disable-root", "-base-path", "/app"}, "/foo", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		s := startTestServer(t, tt.args...)
+		res, body := s.get(t, tt.path)
+		s.Close()
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%v %s: got %d, want %d", tt.args, tt.path, res.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == http.StatusNotFound && !strings.Contains(body, "<title>Not found</title>") {
+			t.Errorf("%v %s: the 404 isn't the not found page: %.80q", tt.args, tt.path, body)
+		}
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	setTestFlags(t)
+	defer setRedis(nil)
+	started := make(chan struct{})
+	router := newRouter(nil, nil, make(chan os.Signal, 1))
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	logs := &syncBuffer{}
+	logger := log.New(logs, "http: ", log.LstdFlags)
+	conns := newConnTracker()
+	s := httptest.NewUnstartedServer(newHandler(router, noMetrics{}, logger, nil))
+	s.Config.ConnState = conns.track
+	s.Start()
+	defer s.Close()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := http.Get(s.URL + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		slow <- result{res.StatusCode, string(body), err}
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- shutdownServer(s.Config, conns, make(chan struct{}), logger) }()
+
+	// new connections are refused while the slow request carries on
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err := client.Get(s.URL + "/uptime")
+		if err != nil {
+			break
+		}
+		res.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("still accepting requests a second into shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case r := <-slow:
+		t.Fatalf("the slow request finished before new ones were refused: %+v", r)
+	default:
+	}
+
+	r := <-slow
+	if r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Errorf("the in-flight request didn't finish: got %d %q, %v", r.status, r.body, r.err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(logs.String(), "Drained in") {
+		t.Errorf("no drained line in the logs:\n%s", logs.String())
+	}
+}
+
+func TestShutdownDrainsH2C(t *testing.T) {
+	setTestFlags(t, "-h2c")
+	defer setRedis(nil)
+	started := make(chan struct{})
+	var finished int32
+	router := newRouter(nil, nil, make(chan os.Signal, 1))
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+		atomic.StoreInt32(&finished, 1)
+	})
+	logger := log.New(ioutil.Discard, "", 0)
+	conns := newConnTracker()
+	s := httptest.NewUnstartedServer(newHandler(router, noMetrics{}, logger, nil))
+	s.Config.ConnState = conns.track
+	if err := serveH2C(s.Config, conns); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	// prior knowledge h2c, HTTP/2 straight away without TLS
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	type result struct {
+		proto  int
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		res, err := client.Get(s.URL + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		slow <- result{res.ProtoMajor, res.StatusCode, string(body), err}
+	}()
+	<-started
+
+	if err := shutdownServer(s.Config, conns, make(chan struct{}), logger); err != nil {
+		t.Error(err)
+	}
+	if atomic.LoadInt32(&finished) == 0 {
+		t.Error("shutdown didn't wait for the h2c request in flight")
+	}
+	r := <-slow
+	if r.err != nil || r.proto != 2 || r.status != http.StatusOK || r.body != "done" {
+		t.Errorf("the in-flight h2c request didn't finish: got HTTP/%d %d %q, %v", r.proto, r.status, r.body, r.err)
+	}
+}
+
+func BenchmarkHandlerConnected(b *testing.B) {
+	fake := startFakeRedis(b, 0)
+	defer fake.close()
+	setTestFlags(b, "-no-redis=false", "-redis", fake.addr())
+	defer setRedis(nil)
+	benchmarkHandler(b)
+	if fake.pinged() == 0 {
+		b.Error("the home page never checked Redis")
+	}
+}
+
+// Redis is configured but nothing is listening, so every check has to
+// connect and fail
+func BenchmarkHandlerDisconnected(b *testing.B) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+	setTestFlags(b, "-no-redis=false", "-redis", closed)
+	defer setRedis(nil)
+	benchmarkHandler(b)
+}
+
+// benchmarkHandler is the home page on its own, without the middleware
+// or a real connection in the way. What it logs is dropped, the failed
+// checks would bury the results
+func benchmarkHandler(b *testing.B) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), loggerKey, log.New(ioutil.Discard, "", 0)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("got %d, want 200", w.Code)
+		}
+	}
+}
+
+// every JSON route newRouter can register is in openapi.json, and nothing
+// else is
+func TestOpenAPICoversRoutes(t *testing.T) {
+	setTestFlags(t, "-admin-user", "admin", "-admin-pass", "secret", "-enable-remote-shutdown")
+	defer setRedis(nil)
+	router := newRouter(nil, nil, make(chan os.Signal, 1))
+
+	data, err := ioutil.ReadFile(filepath.Join("static", "openapi.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	// the page, static files and /livez, which has no body
+	notJSON := map[string]bool{"/": true, "/style.css": true, "/background.jpg": true, "/favicon.ico": true, "/livez": true}
+	documented := map[string]bool{}
+	for _, pattern := range router.patterns {
+		if notJSON[pattern] {
+			continue
+		}
+		path := pattern
+		if strings.HasSuffix(path, "/") {
+			path += "{index}"
+		}
+		documented[path] = true
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("%s is registered but not in openapi.json", pattern)
+		}
+	}
+	for path := range spec.Paths {
+		if !documented[path] {
+			t.Errorf("%s is in openapi.json but not registered", path)
+		}
+	}
+}
+
+// streaming and connection takeover still work through every wrapper the
+// middleware puts around the ResponseWriter
+func TestResponseWriterInterfaces(t *testing.T) {
+	stream := func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't a Flusher", w), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("first "))
+		f.Flush()
+		w.Write([]byte("second"))
+	}
+	hijack := func(w http.ResponseWriter, r *http.Request) {
+		h, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't a Hijacker", w), http.StatusInternalServerError)
+			return
+		}
+		conn, buf, err := h.Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		buf.Flush()
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"-gzip"},
+		{"-request-timeout", "1s"},
+		{"-request-id-trailer"},
+		{"-audit-log", os.DevNull},
+		{"-rate-limit", "100"},
+	} {
+		s := startTestRouter(t, map[string]http.HandlerFunc{"/stream": stream, "/hijack": hijack}, args...)
+		res, body := s.get(t, "/stream")
+		if res.StatusCode != http.StatusOK || body != "first second" {
+			t.Errorf("%v: streaming got %d %q", args, res.StatusCode, body)
+		}
+		res, body = s.get(t, "/hijack")
+		if res.StatusCode != http.StatusOK || body != "hijacked" {
+			t.Errorf("%v: hijacking got %d %q", args, res.StatusCode, body)
+		}
+		// Close doesn't wait for hijacked connections, so let the
+		// handler finish before the next flags are set
+		waitFor(t, "the hijacked request to be logged", func() bool {
+			return strings.Contains(s.logs.String(), "/hijack")
+		})
+		s.Close()
+	}
+
+	// a client that accepts no encoding still reaches the handler, held
+	// behind the 406 writer
+	s := startTestRouter(t, map[string]http.HandlerFunc{"/hijack": hijack}, "-gzip")
+	defer s.Close()
+	res, body := s.get(t, "/hijack", "Accept-Encoding", "identity;q=0")
+	if res.StatusCode != http.StatusOK || body != "hijacked" {
+		t.Errorf("strict Accept-Encoding: hijacking got %d %q", res.StatusCode, body)
+	}
+	waitFor(t, "the hijacked request to be logged", func() bool {
+		return strings.Contains(s.logs.String(), "/hijack")
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupCPULimit is the container's CPU quota in whole CPUs, rounded up,
+// or 0 when there isn't one or it can't be read. cgroup v2 is tried first
+func cgroupCPULimit() int {
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		// "max 100000" when unlimited, "50000 100000" for half a CPU
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return cpusFromQuota(fields[0], fields[1])
+		}
+		return 0
+	}
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return cpusFromQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpusFromQuota(quota, period string) int {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int(math.Ceil(q / p))
+}
+
+// setMaxProcs applies -maxprocs, or with 0 the cgroup CPU limit, and says
+// where the value came from. GOMAXPROCS in the environment beats detection
+// but not the flag
+func setMaxProcs(flagValue int) (int, string) {
+	if flagValue > 0 {
+		runtime.GOMAXPROCS(flagValue)
+		return flagValue, "-maxprocs"
+	}
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		return runtime.GOMAXPROCS(0), "GOMAXPROCS"
+	}
+	if limit := cgroupCPULimit(); limit > 0 && limit < runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(limit)
+		return limit, "cgroup CPU limit"
+	}
+	return runtime.GOMAXPROCS(0), "default"
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// counters is an expvar map of maps of counts, like {"/readyz": {"2xx": 3}}
+type counters struct {
+	mu sync.Mutex
+	m  *expvar.Map
+}
+
+func newCounters(name string) *counters {
+	return &counters{m: expvar.NewMap(name)}
+}
+
+func (c *counters) add(outer, inner string) {
+	c.mu.Lock()
+	counts, ok := c.m.Get(outer).(*expvar.Map)
+	if !ok {
+		counts = new(expvar.Map).Init()
+		c.m.Set(outer, counts)
+	}
+	c.mu.Unlock()
+	counts.Add(inner, 1)
+}
+
+// requestsByRoute counts responses by status class under the pattern the
+// route was registered with, never the raw path, so the number of keys
+// stays bounded however many different URLs get requested
+var requestsByRoute = newCounters("requests_by_route")
+
+// routeMetrics counts every request against the router pattern that
+// serves it, in expvar and the backend. Anything the router only 404s
+// still lands on the catch all pattern of the root
+func routeMetrics(router *http.ServeMux, backend metricsBackend) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, pattern := router.Handler(r)
+			if pattern == "" {
+				pattern = "unmatched"
+			}
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			panicked := true
+			defer func() {
+				status := rw.finalStatus(panicked)
+				requestsByRoute.add(pattern, strconv.Itoa(status/100)+"xx")
+				backend.incrRequest(pattern, status)
+				backend.observeLatency(pattern, time.Since(start))
+			}()
+			next.ServeHTTP(rw, r)
+			panicked = false
+		})
+	}
+}
+
+// histogram counts durations into buckets of at most each bound, in
+// seconds, published in expvar like
+// {"buckets": {"0.001": 3, "0.005": 9, "+Inf": 9}, "count": 9, "sum": 0.0042}.
+// Buckets are cumulative, as in Prometheus
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+}
+
+func newHistogram(name string, bounds ...float64) *histogram {
+	h := &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+	expvar.Publish(name, expvar.Func(h.snapshot))
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += secs
+	for i, bound := range h.bounds {
+		if secs <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+}
+
+func (h *histogram) snapshot() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]int64, len(h.counts))
+	for i, bound := range h.bounds {
+		buckets[strconv.FormatFloat(bound, 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.counts[len(h.bounds)]
+	return map[string]interface{}{
+		"buckets": buckets,
+		"count":   h.counts[len(h.bounds)],
+		"sum":     h.sum,
+	}
+}
+
+// renderDuration is the time spent filling in the home page template, on
+// its own so it doesn't get lost in the Redis check and the whole request
+var renderDuration = newHistogram("render_duration_seconds", 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01)
+
+// metricsHandler is expvar.Handler with secret flags redacted from the
+// cmdline variable that expvar publishes on its own
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprintf(w, "{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if !first {
+				fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			value := kv.Value.String()
+			if kv.Key == "cmdline" {
+				args, _ := json.Marshal(redactArgs(os.Args))
+				value = string(args)
+			}
+			fmt.Fprintf(w, "%q: %s", kv.Key, value)
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
+
+// redactArgs replaces the values of secretFlags in a command line
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i := 1; i < len(redacted); i++ {
+		name := strings.TrimLeft(redacted[i], "-")
+		if name == redacted[i] {
+			continue
+		}
+		if eq := strings.Index(name, "="); eq >= 0 {
+			if secretFlags[name[:eq]] {
+				redacted[i] = redacted[i][:len(redacted[i])-len(name)+eq+1] + "[redacted]"
+			}
+			continue
+		}
+		if secretFlags[name] && i+1 < len(redacted) {
+			i++
+			redacted[i] = "[redacted]"
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// the admin password given on the command line never shows up in the
+// cmdline /metrics passes on from expvar, however it was written
+func TestMetricsRedactsAdminPass(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{"helloworld", "-debug", "-admin-pass", "hunter2", "--admin-pass=hunter3", "-admin-pass=hunter4", "-admin-user", "admin"}
+
+	s := startTestServer(t, "-admin-user", "admin", "-admin-pass", "secret")
+	defer s.Close()
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	res, body := s.get(t, "/metrics", "Authorization", req.Header.Get("Authorization"))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, want 200", res.StatusCode)
+	}
+	if strings.Contains(body, "hunter") {
+		t.Errorf("the admin password is in /metrics:\n%s", body)
+	}
+
+	var vars struct {
+		Cmdline []string `json:"cmdline"`
+	}
+	if err := json.Unmarshal([]byte(body), &vars); err != nil {
+		t.Fatalf("/metrics isn't JSON: %v\n%s", err, body)
+	}
+	want := []string{"helloworld", "-debug", "-admin-pass", "[redacted]", "--admin-pass=[redacted]", "-admin-pass=[redacted]", "-admin-user", "admin"}
+	if strings.Join(vars.Cmdline, " ") != strings.Join(want, " ") {
+		t.Errorf("cmdline is %q, want %q", vars.Cmdline, want)
+	}
+}
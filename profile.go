@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// startupProfile writes a CPU profile of the first d after startup to
+// path. The returned stop ends it early, for a shutdown within d, and is
+// safe to call more than once
+func startupProfile(path string, d time.Duration, logger *log.Logger) (stop func(), err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	logger.Printf("Writing a CPU profile of the next %s to %s\n", d, path)
+
+	start := time.Now()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil {
+				logger.Printf("Could not write the startup profile to %s: %v\n", path, err)
+				return
+			}
+			logger.Printf("Wrote %s of startup CPU profile to %s\n", time.Since(start).Round(time.Millisecond), path)
+		})
+	}
+	time.AfterFunc(d, stop)
+	return stop, nil
+}
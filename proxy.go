@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// proxies whose X-Forwarded-* headers we believe, set with -trusted-proxies
+var trustedProxies []*net.IPNet
+
+// parseNetworks takes a comma separated list of IPs and CIDRs
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q: %v", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy reports whether the request came straight from one of the
+// trusted proxies
+func fromTrustedProxy(r *http.Request) bool {
+	ip := peerIP(r)
+	return ip != nil && trustedIP(ip)
+}
+
+// peerIP is the address of whatever is on the other end of the connection,
+// nil if it can't be worked out
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func trustedIP(ip net.IP) bool {
+	return inNetworks(ip, trustedProxies)
+}
+
+func inNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client, taken from X-Forwarded-For when
+// the request came through a trusted proxy
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r) {
+		return host
+	}
+
+	// the proxy appends the address it saw, so walk back from the end until
+	// we find one that isn't one of ours
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !trustedIP(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// requestScheme is the scheme the client used. X-Forwarded-Proto is only
+// honoured from trusted proxies, anyone else could use it to make us
+// generate links with the wrong scheme
+func requestScheme(r *http.Request) string {
+	if fromTrustedProxy(r) {
+		switch proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type pusherOptions struct {
+	key    string
+	maxLen int64
+	// items pushed each cycle
+	batch int
+	// each cycle waits a random time between these
+	intervalMin time.Duration
+	intervalMax time.Duration
+}
+
+// pusher pushes new items onto a Redis list on a random cycle, keeping the
+// list at no more than maxLen items
+type pusher struct {
+	pusherOptions
+	logger *log.Logger
+	// only used by run, seeded per process so replicas started together
+	// don't push in step
+	rng *rand.Rand
+
+	started time.Time
+	// unix nanos of when the next cycle is due, 0 when not scheduled
+	nextPush int64
+	// unix nanos of the last successful push, 0 if there hasn't been one
+	lastSuccess int64
+	pushes      int64
+	pushErrors  int64
+	panics      int64
+	// items dropped off the end to keep to maxLen
+	trimmed int64
+
+	// called at the start of every push when set, for tests
+	onPush func()
+}
+
+func newPusher(opts pusherOptions, logger *log.Logger) *pusher {
+	return &pusher{
+		pusherOptions: opts,
+		logger:        logger,
+		rng:           rand.New(rand.NewSource(randomSeed())),
+		started:       time.Now(),
+	}
+}
+
+// randomSeed comes from crypto/rand, falling back to the clock if that
+// fails
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// run pushes until stop is closed
+func (p *pusher) run(stop <-chan struct{}) {
+	for {
+		wait := p.intervalMin
+		if p.intervalMax > p.intervalMin {
+			wait += time.Duration(p.rng.Int63n(int64(p.intervalMax - p.intervalMin)))
+		}
+		atomic.StoreInt64(&p.nextPush, time.Now().Add(wait).UnixNano())
+		select {
+		case <-stop:
+			atomic.StoreInt64(&p.nextPush, 0)
+			return
+		case <-time.After(wait):
+		}
+
+		if err := p.safePush(); err != nil {
+			atomic.AddInt64(&p.pushErrors, 1)
+			p.logger.Printf("Could not push onto %s: %v\n", p.key, err)
+			continue
+		}
+		atomic.AddInt64(&p.pushes, int64(p.batch))
+		atomic.StoreInt64(&p.lastSuccess, time.Now().UnixNano())
+	}
+}
+
+// safePush is push that turns a panic into an error, so a bad cycle can't
+// kill the pusher. It carries on with the next cycle and, as the failed
+// cycle doesn't count as a success, readiness goes stale if it keeps failing
+func (p *pusher) safePush() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&p.panics, 1)
+			p.logger.Printf("Pusher panicked: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.push()
+}
+
+// push adds a batch of items and trims the list in one MULTI/EXEC so the
+// list is never left longer than maxLen. Failing to connect is retried a
+// few times before the cycle counts as failed. A connection that drops
+// after that isn't, EXEC may have run. Items are the time of the cycle and
+// their place in the batch, so should a batch ever land twice it shows
+func (p *pusher) push() error {
+	if p.onPush != nil {
+		p.onPush()
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	items := make([]interface{}, p.batch)
+	for i := range items {
+		items[i] = fmt.Sprintf("%s-%d", now, i)
+	}
+	client := currentRedis()
+	if client == nil {
+		return errNoRedisClient
+	}
+	var length *redis.IntCmd
+	err := retryRedis(3, 100*time.Millisecond, func() error {
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			length = pipe.LPush(p.key, items...)
+			pipe.LTrim(p.key, 0, p.maxLen-1)
+			return nil
+		})
+		return err
+	})
+	// LPUSH says how long the list was before the trim, only say
+	// something when the trim actually dropped items
+	if err == nil && length.Val() > p.maxLen {
+		trimmed := length.Val() - p.maxLen
+		atomic.AddInt64(&p.trimmed, trimmed)
+		if debugMode {
+			p.logger.Printf("DEBUG Trimmed %d items off %s, it has %d\n", trimmed, p.key, p.maxLen)
+		}
+	}
+	return err
+}
+
+// healthy reports whether the last successful push happened within
+// staleness. A pusher that has only just started gets the same grace period
+func (p *pusher) healthy(staleness time.Duration) bool {
+	last := atomic.LoadInt64(&p.lastSuccess)
+	if last == 0 {
+		return time.Since(p.started) < staleness
+	}
+	return time.Since(time.Unix(0, last)) < staleness
+}
+
+// publishMetrics exports the pusher's counters under "pusher" in expvar.
+// It can only be called once
+func (p *pusher) publishMetrics() {
+	m := expvar.NewMap("pusher")
+	m.Set("pushes", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&p.pushes)
+	}))
+	m.Set("push_errors", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&p.pushErrors)
+	}))
+	m.Set("panics", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&p.panics)
+	}))
+	m.Set("trimmed", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&p.trimmed)
+	}))
+	m.Set("last_push", expvar.Func(func() interface{} {
+		last := atomic.LoadInt64(&p.lastSuccess)
+		if last == 0 {
+			return nil
+		}
+		return time.Unix(0, last).UTC().Format(time.RFC3339Nano)
+	}))
+	m.Set("next_push", expvar.Func(func() interface{} {
+		next := atomic.LoadInt64(&p.nextPush)
+		if next == 0 {
+			return nil
+		}
+		return time.Unix(0, next).UTC().Format(time.RFC3339Nano)
+	}))
+	// -1 when Redis can't be asked
+	m.Set("stack_length", expvar.Func(func() interface{} {
+		client := currentRedis()
+		if client == nil {
+			return -1
+		}
+		n, err := client.LLen(p.key).Result()
+		if err != nil {
+			return -1
+		}
+		return n
+	}))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryRedis(t *testing.T) {
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	tests := []struct {
+		err   error
+		tries int
+	}{
+		{nil, 1},
+		{dial, 3},
+		// the commands got there, they may have run
+		{read, 1},
+		{io.EOF, 1},
+		{errors.New("ERR wrong type"), 1},
+	}
+	for _, tt := range tests {
+		tries := 0
+		err := retryRedis(3, time.Millisecond, func() error {
+			tries++
+			return tt.err
+		})
+		if err != tt.err || tries != tt.tries {
+			t.Errorf("%v: tried %d times and got %v, want %d times", tt.err, tries, err, tt.tries)
+		}
+	}
+}
+
+func TestPushIsNotRetriedAfterExec(t *testing.T) {
+	redis := startFakeRedis(t, 0)
+	defer redis.close()
+	redis.hangUpOn = "EXEC"
+	setRedis(newRedisClient(redis.addr()))
+	defer setRedis(nil)
+
+	p := newPusher(pusherOptions{key: "stack", maxLen: 10, batch: 2}, log.New(ioutil.Discard, "", 0))
+	if err := p.push(); err == nil {
+		t.Fatal("the push succeeded without a reply to EXEC")
+	}
+	if n := redis.received("EXEC"); n != 1 {
+		t.Errorf("EXEC was sent %d times, a retry could push the batch twice", n)
+	}
+}
+
+// waitFor polls cond until it holds or a second has gone by
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPusherSurvivesRedisErrors(t *testing.T) {
+	broken := startFakeRedis(t, 0)
+	defer broken.close()
+	broken.hangUpOn = "EXEC"
+	working := startFakeRedis(t, 0)
+	defer working.close()
+	setRedis(newRedisClient(broken.addr()))
+	defer setRedis(nil)
+
+	p := newPusher(pusherOptions{key: "stack", maxLen: 10, batch: 2, intervalMin: time.Millisecond, intervalMax: 2 * time.Millisecond}, log.New(ioutil.Discard, "", 0))
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		p.run(stop)
+		close(done)
+	}()
+
+	waitFor(t, "failed pushes", func() bool { return atomic.LoadInt64(&p.pushErrors) >= 3 })
+	setRedis(newRedisClient(working.addr()))
+	waitFor(t, "pushes once Redis works", func() bool { return atomic.LoadInt64(&p.pushes) > 0 })
+	if !p.healthy(time.Minute) {
+		t.Error("the pusher isn't healthy after pushing")
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the pusher didn't stop")
+	}
+}
+
+func TestPusherRecoversFromPanics(t *testing.T) {
+	redis := startFakeRedis(t, 0)
+	defer redis.close()
+	setRedis(newRedisClient(redis.addr()))
+	defer setRedis(nil)
+
+	logs := &syncBuffer{}
+	p := newPusher(pusherOptions{key: "stack", maxLen: 10, batch: 2, intervalMin: time.Millisecond, intervalMax: 2 * time.Millisecond}, log.New(logs, "", 0))
+	var calls int32
+	p.onPush = func() {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("boom")
+		}
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.run(stop)
+
+	waitFor(t, "a push after the panic", func() bool { return atomic.LoadInt64(&p.pushes) > 0 })
+	if n := atomic.LoadInt64(&p.panics); n != 1 {
+		t.Errorf("counted %d panics, want 1", n)
+	}
+	if n := atomic.LoadInt64(&p.pushErrors); n != 1 {
+		t.Errorf("counted %d failed pushes, want the 1 that panicked", n)
+	}
+	if !strings.Contains(logs.String(), "Pusher panicked: boom") || !strings.Contains(logs.String(), ".push(") {
+		t.Errorf("the panic and its stack weren't logged:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// rateLimiter counts requests per key in fixed windows. It gives up once
+// ctx is done
+type rateLimiter interface {
+	allow(ctx context.Context, key string) (bool, error)
+}
+
+// memoryLimiter only knows about requests to this instance
+type memoryLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newMemoryLimiter(limit int, window time.Duration) *memoryLimiter {
+	return &memoryLimiter{
+		limit:  limit,
+		window: window,
+		start:  time.Now(),
+		counts: map[string]int{},
+	}
+}
+
+func (l *memoryLimiter) allow(ctx context.Context, key string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// starting a new window also forgets everyone from the old one, so
+	// the map can't grow forever
+	if time.Since(l.start) >= l.window {
+		l.start = time.Now()
+		l.counts = map[string]int{}
+	}
+	l.counts[key]++
+	return l.counts[key] <= l.limit, nil
+}
+
+// redisLimiter shares its counts with every instance using the same Redis
+type redisLimiter struct {
+	limit  int
+	window time.Duration
+}
+
+func (l *redisLimiter) allow(ctx context.Context, key string) (bool, error) {
+	window := time.Now().UnixNano() / int64(l.window)
+	counter := redisKey(fmt.Sprintf("ratelimit:%s:%d", key, window))
+
+	client := currentRedis()
+	if client == nil {
+		return false, errNoRedisClient
+	}
+
+	// one quick retry, this is on the request path and the memory limiter
+	// takes over if Redis stays away
+	var incr *redis.IntCmd
+	err := withContext(ctx, func() error {
+		return retryRedis(2, 10*time.Millisecond, func() error {
+			_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+				incr = pipe.Incr(counter)
+				pipe.Expire(counter, l.window)
+				return nil
+			})
+			return err
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return incr.Val() <= int64(l.limit), nil
+}
+
+// rateLimiting rejects clients going over the limit with a 429. When the
+// primary limiter fails, fallback is used instead until it recovers
+func rateLimiting(primary, fallback rateLimiter, window time.Duration, skip map[string]bool) func(http.Handler) http.Handler {
+	var degraded int32
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := clientIP(r)
+			start := time.Now()
+			allowed, err := primary.allow(r.Context(), key)
+			if err != nil && fallback != nil {
+				if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+					redisFallbacks.add("ratelimit", "error")
+					requestLogger(r.Context()).Printf("Rate limiter failed after %s, falling back to in-memory limits: %v\n", time.Since(start), err)
+				}
+				allowed, _ = fallback.allow(r.Context(), key)
+			} else if err == nil && atomic.CompareAndSwapInt32(&degraded, 1, 0) {
+				requestLogger(r.Context()).Println("Rate limiter recovered")
+			}
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(window.Seconds())))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
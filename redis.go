@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// shared by everything that talks to Redis, swapped on config reload
+	redisMu     sync.RWMutex
+	redisClient *redis.Client
+
+	// result of the most recent ping, 1 when connected
+	redisConnected int32
+
+	redisStats redisStateStats
+
+	// requests that need Redis at the same moment share one PING
+	redisPings singleflight.Group
+
+	// requests that took the result of a PING already in flight (shared)
+	// or sent their own (live), to see how much load the sharing saves
+	redisChecks = expvar.NewMap("redis_checks")
+)
+
+// what the last check found, as shown in /readyz and redis_state
+const (
+	redisStatusConnected   = "connected"
+	redisStatusAuthFailed  = "auth failed"
+	redisStatusUnreachable = "unreachable"
+	redisStatusNotRedis    = "not redis"
+)
+
+// redisAuthError is a reply from Redis refusing our credentials, as opposed
+// to not getting a reply at all
+type redisAuthError struct {
+	err error
+}
+
+func (e redisAuthError) Error() string {
+	return "authentication failed: " + e.err.Error()
+}
+
+// redisProtocolError is a reply that isn't RESP at all, -redis pointing at
+// something that isn't Redis, like an HTTP server
+type redisProtocolError struct {
+	err error
+}
+
+func (e redisProtocolError) Error() string {
+	return "not the Redis protocol: " + e.err.Error()
+}
+
+// errNoRedisClient is what needing Redis without a client comes to, with
+// -no-redis there never is one
+var errNoRedisClient = errors.New("no Redis client")
+
+// go-redis gives up on a reply it can't make sense of with this
+func isProtocolError(err error) bool {
+	return strings.HasPrefix(err.Error(), "redis: can't parse")
+}
+
+// authReplies start the errors Redis sends for a missing or wrong password
+var authReplies = []string{"NOAUTH", "WRONGPASS", "ERR invalid password", "ERR AUTH", "ERR Client sent AUTH"}
+
+func isAuthReply(err error) bool {
+	for _, prefix := range authReplies {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redisStatusOf is the status a checkRedis error stands for
+func redisStatusOf(err error) string {
+	if err == nil {
+		return redisStatusConnected
+	}
+	if _, ok := err.(redisAuthError); ok {
+		return redisStatusAuthFailed
+	}
+	if _, ok := err.(redisProtocolError); ok {
+		return redisStatusNotRedis
+	}
+	return redisStatusUnreachable
+}
+
+// redisStateStats adds up how long Redis has been connected and degraded
+// (not connected) for, from the state changes seen by checkRedis
+type redisStateStats struct {
+	mu             sync.Mutex
+	checked        bool
+	connected      bool
+	status         string
+	lastTransition time.Time
+	connectedFor   time.Duration
+	degradedFor    time.Duration
+}
+
+// record notes the result of a check and reports whether it changed the
+// state. The first check always counts as a change
+func (s *redisStateStats) record(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	connected := err == nil
+	s.status = redisStatusOf(err)
+	now := time.Now()
+	if s.checked && s.connected == connected {
+		return false
+	}
+	if s.checked {
+		if s.connected {
+			s.connectedFor += now.Sub(s.lastTransition)
+		} else {
+			s.degradedFor += now.Sub(s.lastTransition)
+		}
+	}
+	s.checked = true
+	s.connected = connected
+	s.lastTransition = now
+	return true
+}
+
+// currentStatus is the status from the last check, "" before the first
+func (s *redisStateStats) currentStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// snapshot returns the totals including the current, unfinished period
+func (s *redisStateStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.checked {
+		return map[string]interface{}{"status": nil, "connected_seconds": 0, "degraded_seconds": 0, "last_transition": nil}
+	}
+	connectedFor, degradedFor := s.connectedFor, s.degradedFor
+	if s.connected {
+		connectedFor += time.Since(s.lastTransition)
+	} else {
+		degradedFor += time.Since(s.lastTransition)
+	}
+	return map[string]interface{}{
+		"status":            s.status,
+		"connected_seconds": connectedFor.Seconds(),
+		"degraded_seconds":  degradedFor.Seconds(),
+		"last_transition":   s.lastTransition.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func newRedisClient(addr string) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: "", // no password set
+		DB:       0,  // use default DB
+	})
+	// every command goes through these, so every failure is counted
+	client.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			err := process(cmd)
+			countRedisError(cmd, err)
+			return err
+		}
+	})
+	client.WrapProcessPipeline(func(process func([]redis.Cmder) error) func([]redis.Cmder) error {
+		return func(cmds []redis.Cmder) error {
+			err := process(cmds)
+			for _, cmd := range cmds {
+				countRedisError(cmd, cmd.Err())
+			}
+			return err
+		}
+	})
+	return client
+}
+
+// failed Redis commands by command and then timeout, conn, auth, protocol
+// or other
+var redisErrors = newCounters("redis_errors")
+
+func countRedisError(cmd redis.Cmder, err error) {
+	// Nil is a missing key, not a failure
+	if err == nil || err == redis.Nil {
+		return
+	}
+	class := "other"
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		class = "timeout"
+	} else if connectionError(err) {
+		class = "conn"
+	} else if isAuthReply(err) {
+		class = "auth"
+	} else if isProtocolError(err) {
+		class = "protocol"
+	}
+	redisErrors.add(cmd.Name(), class)
+}
+
+// times a feature went from using Redis to keeping things in memory, by
+// feature and then disconnected or error. Only the switch is counted, not
+// every request served while degraded
+var redisFallbacks = newCounters("redis_fallbacks")
+
+// redisKey puts -redis-prefix in front of name, so instances sharing a
+// Redis database don't trip over each other's keys
+func redisKey(name string) string {
+	if redisPrefix == "" {
+		return name
+	}
+	return redisPrefix + ":" + name
+}
+
+func currentRedis() *redis.Client {
+	redisMu.RLock()
+	defer redisMu.RUnlock()
+	return redisClient
+}
+
+// how long a replaced client stays open for the requests and pusher
+// cycles already using it, longer than its read and write timeouts
+const redisCloseGrace = 10 * time.Second
+
+// setRedis replaces the shared client. The old one is closed once anything
+// that got it before the swap has had time to finish with it
+func setRedis(client *redis.Client) {
+	redisMu.Lock()
+	old := redisClient
+	redisClient = client
+	redisMu.Unlock()
+
+	if old != nil {
+		time.AfterFunc(redisCloseGrace, func() {
+			old.Close()
+		})
+	}
+}
+
+// redisAddrFlag is -redis. A reload sets it while /debug/config may be
+// reading it, so the address is only touched under redisMu
+type redisAddrFlag struct {
+	addr *string
+}
+
+func newRedisAddrFlag(p *string, value string) *redisAddrFlag {
+	redisMu.Lock()
+	defer redisMu.Unlock()
+	*p = value
+	return &redisAddrFlag{addr: p}
+}
+
+func (f *redisAddrFlag) String() string {
+	// the zero value, for flag's help output
+	if f == nil || f.addr == nil {
+		return ""
+	}
+	redisMu.RLock()
+	defer redisMu.RUnlock()
+	return *f.addr
+}
+
+func (f *redisAddrFlag) Set(value string) error {
+	redisMu.Lock()
+	defer redisMu.Unlock()
+	*f.addr = value
+	return nil
+}
+
+// currentRedisAddr is -redis as it is now, a reload may have changed it
+func currentRedisAddr() string {
+	redisMu.RLock()
+	defer redisMu.RUnlock()
+	return redisAddr
+}
+
+// checkRedis pings Redis and records the result in redisConnected. Redis
+// turning down our credentials comes back as a redisAuthError, and a reply
+// that isn't RESP as a redisProtocolError. Any reply that isn't an error
+// counts as connected, Redis compatible servers and proxies don't all say
+// PONG
+func checkRedis(client *redis.Client) error {
+	if client == nil {
+		return errNoRedisClient
+	}
+	pong, err := client.Ping().Result()
+	if err == nil && pong != "PONG" {
+		warnOddPong(pong)
+	}
+	if err != nil && isAuthReply(err) {
+		err = redisAuthError{err}
+	} else if err != nil && isProtocolError(err) {
+		err = redisProtocolError{err}
+	}
+
+	var state int32
+	if err == nil {
+		state = 1
+	}
+	atomic.StoreInt32(&redisConnected, state)
+	redisStats.record(err)
+	return err
+}
+
+// the last reply to PING other than PONG, so it is only warned about once
+var oddPong atomic.Value
+
+func warnOddPong(pong string) {
+	if last, _ := oddPong.Load().(string); last == pong {
+		return
+	}
+	oddPong.Store(pong)
+	requestLogger(context.Background()).Printf("WARNING Redis replied %q to PING instead of PONG, treating it as connected\n", pong)
+}
+
+// retryRedis runs fn up to attempts times while it fails because Redis
+// couldn't be dialled, doubling the wait from base between tries. The client
+// redials on its own, this covers the calls made while it does. Nothing
+// else is retried: once the commands have been written, a dropped
+// connection may have lost the reply of an EXEC that ran, and running it
+// again would do everything twice
+func retryRedis(attempts int, base time.Duration, fn func() error) error {
+	wait := base
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || i >= attempts || !dialError(err) {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// withContext runs fn but stops waiting for it once ctx is done. go-redis
+// v6 doesn't take a context, so a call can't be cancelled, but it can't
+// hold up a request past its deadline either. Left behind, fn still ends
+// within the client's read and write timeouts
+func withContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialError is true when the connection to Redis couldn't be made, so
+// nothing was sent
+func dialError(err error) bool {
+	op, ok := err.(*net.OpError)
+	return ok && op.Op == "dial"
+}
+
+// connectionError is true for errors from talking to Redis, as opposed to
+// errors Redis replied with
+func connectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// watchRedis pings Redis every interval until stop is closed, so the state
+// is known even when nothing else is talking to Redis. Changes within
+// logWindow of the last one logged are only counted, see stateLog
+func watchRedis(interval, logWindow time.Duration, stop <-chan struct{}, logger *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	changes := &stateLog{logger: logger, window: logWindow}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		was := atomic.LoadInt32(&redisConnected) == 1
+		err := pingShared(currentRedis())
+		if was && err != nil {
+			changes.change(fmt.Sprintf("Lost connection to Redis: %v", err))
+		} else if !was && err == nil {
+			changes.change("Connected to Redis")
+		} else {
+			changes.quiet(err == nil)
+		}
+	}
+}
+
+// stateLog keeps a flapping Redis from filling the log. A change is logged
+// unless another one was within window, then it is only counted, and the
+// count is logged once the window is over
+type stateLog struct {
+	logger *log.Logger
+	window time.Duration
+	logged time.Time
+	muted  int
+}
+
+func (l *stateLog) change(msg string) {
+	if l.window > 0 && !l.logged.IsZero() && time.Since(l.logged) < l.window {
+		l.muted++
+		return
+	}
+	if l.muted > 0 {
+		msg += fmt.Sprintf(" (and %d changes not logged before this)", l.muted)
+	}
+	l.logger.Println(msg)
+	l.logged, l.muted = time.Now(), 0
+}
+
+// quiet is called on checks that changed nothing, to log what was counted
+// once the window is over
+func (l *stateLog) quiet(connected bool) {
+	if l.muted == 0 || time.Since(l.logged) < l.window {
+		return
+	}
+	state := "disconnected"
+	if connected {
+		state = "connected"
+	}
+	l.logger.Printf("Redis connection changed %d more times since the last change logged, now %s\n", l.muted, state)
+	l.logged, l.muted = time.Now(), 0
+}
+
+func testRedisConnection(client *redis.Client) bool {
+	return checkRedis(client) == nil
+}
+
+// pingShared is checkRedis through redisPings, so requests that come in
+// while the background check is waiting on Redis share its PING
+func pingShared(client *redis.Client) error {
+	if client == nil {
+		return errNoRedisClient
+	}
+	_, err, _ := redisPings.Do(client.Options().Addr, func() (interface{}, error) {
+		return nil, checkRedis(client)
+	})
+	return err
+}
+
+// testRedisConnectionFor is testRedisConnection while handling a request,
+// failures are logged against that request. Concurrent calls for the same
+// Redis wait for the PING already in flight rather than sending their own
+func testRedisConnectionFor(ctx context.Context, client *redis.Client) bool {
+	if client == nil {
+		debugf(ctx, "Redis check: skipped, there is no client")
+		return false
+	}
+	start := time.Now()
+	var err error
+	// only the caller whose function runs sent the PING, Shared is set
+	// for that one too when others joined it
+	check := "shared"
+	sent := false
+	select {
+	case result := <-redisPings.DoChan(client.Options().Addr, func() (interface{}, error) {
+		sent = true
+		return nil, checkRedis(client)
+	}):
+		err = result.Err
+		if sent {
+			check = "live"
+		}
+		redisChecks.Add(check, 1)
+	case <-ctx.Done():
+		// the PING carries on and records its result, we just stop waiting.
+		// Not counted, we never found out whose PING it was
+		err = ctx.Err()
+		check = "abandoned"
+	}
+	debugf(ctx, "Redis check: connected=%t redis_check=%s in %s", err == nil, check, time.Since(start))
+	if err != nil {
+		requestLogger(ctx).Printf("Redis PING failed after %s: %v\n", time.Since(start), err)
+		return false
+	}
+	return true
+}
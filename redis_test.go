@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisReload(t *testing.T) {
+	before := startFakeRedis(t, 0)
+	defer before.close()
+	after := startFakeRedis(t, 0)
+	defer after.close()
+	s := startTestServer(t, "-no-redis=false", "-redis", before.addr())
+	defer s.Close()
+
+	// requests carry on while the address changes under them
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if res, err := http.Get(s.URL + "/"); err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	old := currentRedis()
+	if err := (&redisAddrFlag{addr: &redisAddr}).Set(after.addr()); err != nil {
+		t.Fatal(err)
+	}
+	reloadable["redis"](log.New(ioutil.Discard, "", 0))
+	close(stop)
+	wg.Wait()
+
+	if got := currentRedis().Options().Addr; got != after.addr() {
+		t.Errorf("the client is for %s after the reload, want %s", got, after.addr())
+	}
+	if err := old.Ping().Err(); err != nil {
+		t.Errorf("the old client was closed while it could still be in use: %v", err)
+	}
+	pinged := after.pinged()
+	s.get(t, "/")
+	if after.pinged() == pinged {
+		t.Error("the home page didn't check the new Redis")
+	}
+}
+
+func TestConcurrentChecksShareOnePing(t *testing.T) {
+	fake := startFakeRedis(t, 100*time.Millisecond)
+	defer fake.close()
+	client := newRedisClient(fake.addr())
+	defer client.Close()
+	live, shared := redisCheckCount("live"), redisCheckCount("shared")
+
+	const n = 10
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if !testRedisConnectionFor(context.Background(), client) {
+				t.Error("the check failed")
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := fake.pinged(); got != 1 {
+		t.Errorf("%d checks sent %d PINGs, want 1", n, got)
+	}
+	if got := redisCheckCount("live") - live; got != 1 {
+		t.Errorf("redis_checks live went up by %d, want 1", got)
+	}
+	if got := redisCheckCount("shared") - shared; got != n-1 {
+		t.Errorf("redis_checks shared went up by %d, want %d", got, n-1)
+	}
+}
+
+func redisCheckCount(check string) int64 {
+	v, ok := redisChecks.Get(check).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestReadyzAfterRedisRestart(t *testing.T) {
+	fake := startFakeRedis(t, 0)
+	defer fake.close()
+	s := startTestServer(t, "-no-redis=false", "-redis", fake.addr(), "-readiness-cache-ttl", "0s")
+	defer s.Close()
+	// the watcher is stopped and done before the next test resets what it
+	// writes
+	stop, done := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	go func() {
+		watchRedis(5*time.Millisecond, 0, stop, log.New(ioutil.Discard, "", 0))
+		close(done)
+	}()
+
+	redisCheck := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			res, body := s.get(t, "/readyz")
+			var result readiness
+			json.Unmarshal([]byte(body), &result)
+			if result.Checks["redis"] == want {
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("redis %s: got %d, want 200, the page works without Redis", want, res.StatusCode)
+				}
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("/readyz never said redis %s, last said %q", want, result.Checks["redis"])
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	redisCheck(redisStatusConnected)
+	fake.down()
+	redisCheck(redisStatusUnreachable)
+	fake.up(t)
+	redisCheck(redisStatusConnected)
+	if got := currentRedis().Ping().Err(); got != nil {
+		t.Errorf("the client didn't reconnect: %v", got)
+	}
+}
+
+// with Redis configured but no client to hand, every route answers instead
+// of panicking on the nil client
+func TestRoutesWithoutRedisClient(t *testing.T) {
+	s := startTestServer(t, "-no-redis=false", "-admin-user", "admin", "-admin-pass", "secret",
+		"-rate-limit", "100", "-rate-limit-backend", "redis")
+	defer s.Close()
+	setRedis(nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	auth := req.Header.Get("Authorization")
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/", http.StatusOK},
+		{http.MethodGet, "/stack", http.StatusServiceUnavailable},
+		{http.MethodHead, "/stack", http.StatusServiceUnavailable},
+		{http.MethodGet, "/stack/0", http.StatusServiceUnavailable},
+		{http.MethodPost, "/stack/flush", http.StatusServiceUnavailable},
+		{http.MethodPost, "/stack/push-batch", http.StatusServiceUnavailable},
+		{http.MethodGet, "/readyz", http.StatusServiceUnavailable},
+		{http.MethodGet, "/livez", http.StatusNoContent},
+		{http.MethodGet, "/uptime", http.StatusOK},
+		{http.MethodGet, "/whoami", http.StatusOK},
+		{http.MethodGet, "/metrics", http.StatusOK},
+		{http.MethodGet, "/debug/config", http.StatusOK},
+		{http.MethodGet, "/openapi.json", http.StatusOK},
+	}
+	for _, tt := range tests {
+		res, body := s.do(t, tt.method, tt.path, "Authorization", auth)
+		if res.StatusCode != tt.want {
+			t.Errorf("%s %s: got %d, want %d\n%s", tt.method, tt.path, res.StatusCode, tt.want, body)
+		}
+	}
+	if logs := s.logs.String(); strings.Contains(logs, "Panic:") {
+		t.Errorf("a route panicked without a client:\n%s", logs)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// formats -request-id-format accepts
+var requestIDFormats = map[string]bool{
+	"uuid":    true,
+	"nano":    true,
+	"counter": true,
+}
+
+// requestIDGenerator makes IDs for requests that don't bring their own:
+// random UUIDs, the time in nanoseconds, or a counter. Counters start at 1
+// in every process, so they have a random token in front to tell them apart.
+// Clocks can be coarser than a nanosecond, so two requests reading the same
+// time get one apart
+func requestIDGenerator(format string) func() string {
+	switch format {
+	case "nano":
+		var last int64
+		return func() string {
+			for {
+				prev, now := atomic.LoadInt64(&last), time.Now().UnixNano()
+				if now <= prev {
+					now = prev + 1
+				}
+				if atomic.CompareAndSwapInt64(&last, prev, now) {
+					return strconv.FormatInt(now, 10)
+				}
+			}
+		}
+	case "counter":
+		token := randomHex(4)
+		var n uint64
+		return func() string {
+			return token + "-" + strconv.FormatUint(atomic.AddUint64(&n, 1), 10)
+		}
+	default:
+		return newUUID
+	}
+}
+
+// longest X-Request-Id taken from a client
+const requestIDMax = 128
+
+// validRequestID is false for IDs that are empty, too long or have spaces,
+// tabs or anything else that would garble a log line. Those get a fresh ID
+func validRequestID(id string) bool {
+	if id == "" || len(id) > requestIDMax {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID is a version 4 UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// no randomness left, the clock is unique enough for a request ID
+		return strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// randomHex is n random bytes in hex, or the clock if there are none
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
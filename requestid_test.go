@@ -0,0 +1,137 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHideRequestID(t *testing.T) {
+	for _, hide := range []bool{false, true} {
+		var args []string
+		if hide {
+			args = []string{"-hide-request-id"}
+		}
+		s := startTestServer(t, args...)
+		generated, _ := s.get(t, "/uptime")
+		given, _ := s.get(t, "/uptime", "X-Request-Id", "from-the-client")
+		s.Close()
+
+		want := "from-the-client"
+		if hide {
+			want = ""
+		}
+		if got := given.Header.Get("X-Request-Id"); got != want {
+			t.Errorf("hide=%v: X-Request-Id is %q, want %q", hide, got, want)
+		}
+		if got := generated.Header.Get("X-Request-Id"); (got == "") != hide {
+			t.Errorf("hide=%v: X-Request-Id is %q for a request without one", hide, got)
+		}
+		// the one the client sent is still what gets logged
+		if !strings.Contains(s.logs.String(), "from-the-client GET /uptime") {
+			t.Errorf("hide=%v: the client's request ID isn't in the logs:\n%s", hide, s.logs.String())
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	s := startTestServer(t, "-request-id-header", "X-Correlation-Id")
+	defer s.Close()
+
+	res, _ := s.get(t, "/uptime", "X-Correlation-Id", "correlated", "X-Request-Id", "ignored")
+	if got := res.Header.Get("X-Correlation-Id"); got != "correlated" {
+		t.Errorf("X-Correlation-Id is %q, want the one sent", got)
+	}
+	if got := res.Header.Get("X-Request-Id"); got != "" {
+		t.Errorf("X-Request-Id is %q, want it left out", got)
+	}
+	if logs := s.logs.String(); !strings.Contains(logs, "correlated GET /uptime") || strings.Contains(logs, "ignored") {
+		t.Errorf("the request wasn't logged with the X-Correlation-Id:\n%s", logs)
+	}
+
+	res, _ = s.get(t, "/uptime", "X-Request-Id", "ignored")
+	if got := res.Header.Get("X-Correlation-Id"); got == "" || got == "ignored" {
+		t.Errorf("X-Correlation-Id is %q, want a new ID", got)
+	}
+}
+
+// whitespace around an ID is trimmed, whitespace inside one gets it
+// replaced, whichever header carries it
+func TestRequestIDWhitespace(t *testing.T) {
+	tests := []struct {
+		sent string
+		want string // "" for a new ID
+	}{
+		{"  padded  ", "padded"},
+		{"\ttabbed\t", "tabbed"},
+		{" \t mixed\t ", "mixed"},
+		{"has space", ""},
+		{"has\ttab", ""},
+		{" \t ", ""},
+	}
+	for _, header := range []string{"X-Request-Id", "X-Correlation-Id"} {
+		s := startTestServer(t, "-request-id-header", header)
+		for _, tt := range tests {
+			res, _ := s.get(t, "/uptime", header, tt.sent)
+			got := res.Header.Get(header)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("%s %q: got %q, want %q", header, tt.sent, got, tt.want)
+			}
+			if tt.want == "" && (got == "" || strings.TrimSpace(got) != got || strings.ContainsAny(got, " \t") || strings.Contains(tt.sent, got)) {
+				t.Errorf("%s %q: got %q, want a new ID", header, tt.sent, got)
+			}
+		}
+		if logs := s.logs.String(); strings.Contains(logs, "\t") || strings.Contains(logs, "has space") {
+			t.Errorf("%s: a bad ID made it into the logs:\n%s", header, logs)
+		}
+		s.Close()
+	}
+}
+
+// every format hands out a different ID each time, goroutines asking at
+// once included
+func TestRequestIDFormatsUnique(t *testing.T) {
+	shapes := map[string]*regexp.Regexp{
+		"uuid":    regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		"nano":    regexp.MustCompile(`^[0-9]+$`),
+		"counter": regexp.MustCompile(`^[0-9a-f]{8}-[0-9]+$`),
+	}
+	const goroutines, each = 8, 1000
+	for format := range requestIDFormats {
+		next := requestIDGenerator(format)
+		ids := make([][]string, goroutines)
+		var wg sync.WaitGroup
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < each; j++ {
+					ids[i] = append(ids[i], next())
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		seen := map[string]bool{}
+		for _, batch := range ids {
+			for _, id := range batch {
+				if seen[id] {
+					t.Errorf("%s: %q was handed out twice", format, id)
+				}
+				seen[id] = true
+				if !shapes[format].MatchString(id) || !validRequestID(id) {
+					t.Errorf("%s: %q isn't a %s ID", format, id, format)
+				}
+			}
+		}
+		if len(seen) != goroutines*each {
+			t.Errorf("%s: %d different IDs out of %d", format, len(seen), goroutines*each)
+		}
+	}
+
+	// two processes both count from 1, the token tells them apart
+	if a, b := requestIDGenerator("counter")(), requestIDGenerator("counter")(); a == b {
+		t.Errorf("two counters both started with %q", a)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "syscall"
+
+// no SO_REUSEPORT here, see listen
+var reusePortControl func(network, address string, c syscall.RawConn) error
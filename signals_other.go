@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	reloadSignals   = []os.Signal{syscall.SIGHUP}
+	dumpSignals     = []os.Signal{syscall.SIGQUIT}
+)
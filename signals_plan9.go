@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Plan 9 has notes rather than signals. An interrupt note is os.Interrupt,
+// which is also what SIGTERM is there, and hangup still reloads. There is
+// no note for a goroutine dump
+var (
+	shutdownSignals = []os.Signal{os.Interrupt}
+	reloadSignals   = []os.Signal{syscall.SIGHUP}
+	dumpSignals     []os.Signal
+)
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Ctrl+C and Ctrl+Break both arrive as os.Interrupt, and closing the
+// console window or logging off as SIGTERM. There is nothing to send for a
+// reload or a goroutine dump, change the config file and restart instead
+var (
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	reloadSignals   []os.Signal
+	dumpSignals     []os.Signal
+)
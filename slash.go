@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// trailingSlashes makes every route answer at one spelling, with or without
+// a trailing slash, redirecting the other. mode is "strip", "add" or "off".
+// The root keeps its slash and, when adding, so do files like style.css.
+// Routes are registered without the slash, so with "add" the canonical
+// form is trimmed before it reaches them
+func trailingSlashes(mode string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if mode == "off" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := r.URL.Path
+			if p == "/" || p == basePath+"/" || p == basePath {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			hasSlash := strings.HasSuffix(p, "/")
+			trimmed := strings.TrimRight(p, "/")
+			switch {
+			case mode == "strip" && hasSlash:
+				redirectPath(w, r, trimmed)
+			case mode == "add" && path.Ext(trimmed) != "":
+				if hasSlash {
+					redirectPath(w, r, trimmed)
+					return
+				}
+				next.ServeHTTP(w, r)
+			case mode == "add" && !hasSlash:
+				redirectPath(w, r, p+"/")
+			case mode == "add":
+				r2 := new(http.Request)
+				*r2 = *r
+				u := *r.URL
+				u.Path = trimmed
+				u.RawPath = ""
+				r2.URL = &u
+				next.ServeHTTP(w, r2)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// redirectPath sends the client to p with the same query. GET and HEAD get
+// a 301, anything else a 308 so the method and body survive. A p that
+// browsers would take for another host, like //evil.com, is a 404 instead
+func redirectPath(w http.ResponseWriter, r *http.Request, p string) {
+	if strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		notFound(w, r)
+		return
+	}
+	if r.URL.RawQuery != "" {
+		p += "?" + r.URL.RawQuery
+	}
+	code := http.StatusPermanentRedirect
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, p, code)
+}
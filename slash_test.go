@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"testing"
+)
+
+func TestTrailingSlashes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{"strip", "/uptime", http.StatusOK, ""},
+		{"strip", "/uptime/", http.StatusMovedPermanently, "/uptime"},
+		{"strip", "/uptime/?x=1", http.StatusMovedPermanently, "/uptime?x=1"},
+		{"strip", "/", http.StatusOK, ""},
+		{"add", "/uptime", http.StatusMovedPermanently, "/uptime/"},
+		{"add", "/uptime/", http.StatusOK, ""},
+		{"add", "/style.css", http.StatusOK, ""},
+		{"add", "/style.css/", http.StatusMovedPermanently, "/style.css"},
+		{"off", "/uptime/", http.StatusNotFound, ""},
+
+		// these would send the browser to another host
+		{"strip", "//evil.example/", http.StatusNotFound, ""},
+		{"strip", "///evil.example/", http.StatusNotFound, ""},
+		{"strip", "/\\evil.example/", http.StatusNotFound, ""},
+		{"add", "//evil.example/", http.StatusNotFound, ""},
+		{"add", "//evil", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		s := startTestServer(t, "-trailing-slash", tt.mode)
+		res, _ := s.get(t, tt.path)
+		s.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s %s: got %d, want %d", tt.mode, tt.path, res.StatusCode, tt.status)
+		}
+		if got := res.Header.Get("Location"); got != tt.location {
+			t.Errorf("%s %s: Location is %q, want %q", tt.mode, tt.path, got, tt.location)
+		}
+	}
+}
+
+func TestRouteMetricsAfterSlashes(t *testing.T) {
+	for mode, path := range map[string]string{"strip": "/uptime", "add": "/uptime/", "off": "/uptime"} {
+		s := startTestServer(t, "-trailing-slash", mode)
+		uptime, root := routeCount("/uptime", "2xx"), routeCount("/", "2xx")
+		res, _ := s.get(t, path)
+		s.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: got %d, want 200", mode, path, res.StatusCode)
+		}
+		if got := routeCount("/uptime", "2xx") - uptime; got != 1 {
+			t.Errorf("%s %s: counted %d times under /uptime, want 1", mode, path, got)
+		}
+		if got := routeCount("/", "2xx") - root; got != 0 {
+			t.Errorf("%s %s: counted %d times under /, want 0", mode, path, got)
+		}
+	}
+}
+
+func routeCount(route, class string) int64 {
+	counts, ok := requestsByRoute.m.Get(route).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	n, ok := counts.Get(class).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return n.Value()
+}
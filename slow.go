@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// slowRequests logs requests that take longer than threshold, with a dump of
+// all goroutines taken when the threshold passed so it shows where the
+// request was stuck rather than where it ended up
+func slowRequests(threshold time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if threshold <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			var stack []byte
+			dumped := make(chan struct{})
+			watchdog := time.AfterFunc(threshold, func() {
+				stack = allStacks()
+				close(dumped)
+			})
+
+			defer func() {
+				if watchdog.Stop() {
+					return
+				}
+				<-dumped
+				duration := time.Since(start)
+				requestLogger(r.Context()).Printf("WARNING slow request %s %s took %s (threshold %s), goroutines at %s:\n%s",
+					r.Method, r.URL.Path, duration, threshold, threshold, stack)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allStacks returns the stacks of all goroutines, capped at 1MB
+func allStacks() []byte {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= 1<<20 {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
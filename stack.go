@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// readStack lists the newest items on the stack, ?limit of them but never
+// more than max. The limit that was applied is in the reply
+func readStack(max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		client := currentRedis()
+		if client == nil {
+			writeJSONError(w, r, http.StatusServiceUnavailable, "running without Redis")
+			return
+		}
+		limit := max
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				writeJSONError(w, r, http.StatusBadRequest, "limit must be a whole number from 1")
+				return
+			}
+			if n < max {
+				limit = n
+			}
+		}
+
+		key := redisKey(stackKey)
+		var items *redis.StringSliceCmd
+		var length *redis.IntCmd
+		err := withContext(r.Context(), func() error {
+			_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+				items = pipe.LRange(key, 0, limit-1)
+				length = pipe.LLen(key)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			requestLogger(r.Context()).Printf("Could not read %s: %v\n", key, err)
+			writeJSONError(w, r, http.StatusServiceUnavailable, "could not read the stack")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Items  []string `json:"items"`
+			Limit  int64    `json:"limit"`
+			Length int64    `json:"length"`
+		}{
+			Items:  items.Val(),
+			Limit:  limit,
+			Length: length.Val(),
+		})
+	})
+}
+
+// stackItem serves /stack/{index}, the item at index with 0 the newest.
+// Negative indices count back from the oldest, as in LINDEX. ServeMux has
+// no path parameters, so it is routed as /stack/ and parsed here
+func stackItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	client := currentRedis()
+	if client == nil {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "running without Redis")
+		return
+	}
+	index, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, basePath+"/stack/"), 10, 64)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "the index must be a whole number")
+		return
+	}
+
+	key := redisKey(stackKey)
+	var item string
+	err = withContext(r.Context(), func() error {
+		var err error
+		item, err = client.LIndex(key, index).Result()
+		return err
+	})
+	if err == redis.Nil {
+		writeJSONError(w, r, http.StatusNotFound, fmt.Sprintf("no item at index %d", index))
+		return
+	}
+	if err != nil {
+		requestLogger(r.Context()).Printf("Could not read %s: %v\n", key, err)
+		writeJSONError(w, r, http.StatusServiceUnavailable, "could not read the stack")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Index int64  `json:"index"`
+		Item  string `json:"item"`
+	}{
+		Index: index,
+		Item:  item,
+	})
+}
+
+// flushStack empties the stack and says how many items it had
+func flushStack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	client := currentRedis()
+	if client == nil {
+		writeJSONError(w, r, http.StatusServiceUnavailable, "running without Redis")
+		return
+	}
+
+	key := redisKey(stackKey)
+	var length *redis.IntCmd
+	err := withContext(r.Context(), func() error {
+		_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+			length = pipe.LLen(key)
+			pipe.Del(key)
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		requestLogger(r.Context()).Printf("Could not flush %s: %v\n", key, err)
+		writeJSONError(w, r, http.StatusServiceUnavailable, "could not flush the stack")
+		return
+	}
+	requestLogger(r.Context()).Printf("Flushed %d items from %s\n", length.Val(), key)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Removed int64 `json:"removed"`
+	}{
+		Removed: length.Val(),
+	})
+}
+
+// longest item /stack/push-batch takes, in bytes
+const stackItemMax = 1024
+
+// pushBatch pushes a JSON array of strings onto the stack in one
+// MULTI/EXEC, trimmed to -stack-max-len, and says how long the stack is
+// now. Bodies that can't be a batch of at most maxBatch items are turned
+// away before they are read
+func pushBatch(maxBatch int) http.Handler {
+	// quotes, escapes and commas can't take more than this
+	maxBody := int64(maxBatch)*(stackItemMax*6+3) + 2
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		client := currentRedis()
+		if client == nil {
+			writeJSONError(w, r, http.StatusServiceUnavailable, "running without Redis")
+			return
+		}
+		if r.ContentLength > maxBody {
+			writeJSONError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body is over %d bytes, too big for %d items", maxBody, maxBatch))
+			return
+		}
+
+		var items []string
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(&items); err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "expected a JSON array of strings")
+			return
+		}
+		if len(items) == 0 || len(items) > maxBatch {
+			writeJSONError(w, r, http.StatusBadRequest, fmt.Sprintf("a batch is 1 to %d items, got %d", maxBatch, len(items)))
+			return
+		}
+		values := make([]interface{}, len(items))
+		for i, item := range items {
+			if len(item) > stackItemMax {
+				writeJSONError(w, r, http.StatusBadRequest, fmt.Sprintf("item %d is over %d bytes", i, stackItemMax))
+				return
+			}
+			values[i] = item
+		}
+
+		key := redisKey(stackKey)
+		var length *redis.IntCmd
+		err := withContext(r.Context(), func() error {
+			_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.LPush(key, values...)
+				pipe.LTrim(key, 0, stackMaxLen-1)
+				length = pipe.LLen(key)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			requestLogger(r.Context()).Printf("Could not push %d items onto %s: %v\n", len(values), key, err)
+			writeJSONError(w, r, http.StatusServiceUnavailable, "could not push to the stack")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Pushed int   `json:"pushed"`
+			Length int64 `json:"length"`
+		}{
+			Pushed: len(values),
+			Length: length.Val(),
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlushStackDeadline(t *testing.T) {
+	fake := startFakeRedis(t, 500*time.Millisecond)
+	fake.slowOn = "MULTI"
+	defer fake.close()
+	s := startTestServer(t, "-no-redis=false", "-redis", fake.addr(),
+		"-admin-user", "admin", "-admin-pass", "secret", "-request-timeout", "10ms")
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	start := time.Now()
+	res, _ := s.do(t, http.MethodPost, "/stack/flush", "Authorization", req.Header.Get("Authorization"))
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("the flush took %s, it should have given up on Redis at the 10ms deadline", elapsed)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503", res.StatusCode)
+	}
+}
+
+// a large enough body is turned away before net/http sends the 100
+// Continue the client is waiting for, so the body is never sent
+func TestPushBatchExpectContinue(t *testing.T) {
+	fake := startFakeRedis(t, 0)
+	defer fake.close()
+	s := startTestServer(t, "-no-redis=false", "-redis", fake.addr(),
+		"-admin-user", "admin", "-admin-pass", "secret", "-max-batch", "2")
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	authorized := req.Header.Get("Authorization")
+	req.SetBasicAuth("admin", "guess")
+	wrong := req.Header.Get("Authorization")
+
+	tests := []struct {
+		name          string
+		authorization string
+		body          string
+		length        int
+		continued     bool
+		status        int
+	}{
+		{"authorized", authorized, `["a","b"]`, 9, true, http.StatusOK},
+		{"unauthorized", wrong, `["a","b"]`, 9, false, http.StatusUnauthorized},
+		{"no credentials", "", `["a","b"]`, 9, false, http.StatusUnauthorized},
+		{"too big", authorized, "", 1 << 20, false, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST /stack/push-batch HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\nExpect: 100-continue\r\n", tt.length)
+		if tt.authorization != "" {
+			fmt.Fprintf(conn, "Authorization: %s\r\n", tt.authorization)
+		}
+		io.WriteString(conn, "\r\n")
+
+		r := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		continued := res.StatusCode == http.StatusContinue
+		if continued != tt.continued {
+			t.Errorf("%s: 100 Continue sent is %v, want %v", tt.name, continued, tt.continued)
+		}
+		if continued {
+			io.WriteString(conn, tt.body)
+			if res, err = http.ReadResponse(r, nil); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		conn.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: got %d, want %d: %s", tt.name, res.StatusCode, tt.status, body)
+		}
+	}
+}
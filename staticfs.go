@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// filesOnly is an http.FileSystem that won't open directories, so the file
+// server 404s them instead of listing what's in them. Serving the index.html
+// it would look for isn't wanted either, that's the raw page template
+type filesOnly struct {
+	fs http.FileSystem
+}
+
+func (f filesOnly) Open(name string) (http.File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNoDirectoryListings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helloworld-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "img", "secret-name.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := http.FileServer(filesOnly{http.Dir(dir)})
+
+	for _, path := range []string{"/", "/img", "/img/"} {
+		w := httptest.NewRecorder()
+		files.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", path, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "secret-name") {
+			t.Errorf("%s: the directory was listed: %q", path, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	files.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/img/secret-name.png", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "png" {
+		t.Errorf("a file in the directory: got %d %q, want 200 and its content", w.Code, w.Body.String())
+	}
+}
+
+// streamRecorder keeps track of how a response body arrives instead of
+// keeping it
+type streamRecorder struct {
+	header  http.Header
+	code    int
+	bytes   int64
+	writes  int
+	largest int
+	// what ReadFrom was handed, when it was
+	from io.Reader
+}
+
+func (s *streamRecorder) Header() http.Header { return s.header }
+
+func (s *streamRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+func (s *streamRecorder) Write(b []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	s.writes++
+	s.bytes += int64(len(b))
+	if len(b) > s.largest {
+		s.largest = len(b)
+	}
+	return len(b), nil
+}
+
+func (s *streamRecorder) ReadFrom(src io.Reader) (int64, error) {
+	s.WriteHeader(http.StatusOK)
+	s.from = src
+	n, err := io.Copy(ioutil.Discard, src)
+	s.bytes += n
+	return n, err
+}
+
+// a big static file goes out as it's read, nothing on the way holds all
+// of it in memory
+func TestLargeStaticFilesStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helloworld-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := ioutil.ReadFile(filepath.Join("static", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	const size = 16 << 20
+	if err := ioutil.WriteFile(filepath.Join(dir, "background.jpg"), bytes.Repeat([]byte{0xff}, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "style.css"), bytes.Repeat([]byte("body { color: red; }\n"), size/21), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		args     []string
+		sendfile bool
+	}{
+		{"sendfile", "/background.jpg", nil, true},
+		{"copied", "/background.jpg", []string{"-sendfile=false"}, false},
+		{"gzip passing an image through", "/background.jpg", []string{"-gzip"}, true},
+		{"gzip", "/style.css", []string{"-gzip"}, false},
+	}
+	for _, tt := range tests {
+		setTestFlags(t, append([]string{"-static-dir", dir}, tt.args...)...)
+		h := newHandler(newRouter(nil, nil, make(chan os.Signal, 1)), noMetrics{}, log.New(ioutil.Discard, "", 0), nil)
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := &streamRecorder{header: http.Header{}}
+		h.ServeHTTP(w, req)
+
+		if w.code != http.StatusOK || w.bytes == 0 {
+			t.Errorf("%s: got %d with %d bytes", tt.name, w.code, w.bytes)
+			continue
+		}
+		if tt.sendfile {
+			// what the connection gets to sendfile from has to lead back
+			// to the open file
+			src := w.from
+			if lr, ok := src.(*io.LimitedReader); ok {
+				src = lr.R
+			}
+			if _, ok := src.(*os.File); !ok {
+				t.Errorf("%s: the connection was handed a %T, not the file", tt.name, w.from)
+			}
+			continue
+		}
+		if w.from != nil {
+			t.Errorf("%s: the body was handed over as a %T, want plain writes", tt.name, w.from)
+		}
+		if w.writes < 2 || w.largest > 1<<20 {
+			t.Errorf("%s: %d bytes went out in %d writes of up to %d, want it in pieces", tt.name, w.bytes, w.writes, w.largest)
+		}
+	}
+	setRedis(nil)
+}
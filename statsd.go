@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metricsBackend is where request metrics go besides expvar, picked with
+// -metrics-backend
+type metricsBackend interface {
+	incrRequest(route string, status int)
+	observeLatency(route string, d time.Duration)
+	setGauge(name string, value float64)
+}
+
+// noMetrics is the default, it sends nothing anywhere
+type noMetrics struct{}
+
+func (noMetrics) incrRequest(route string, status int)         {}
+func (noMetrics) observeLatency(route string, d time.Duration) {}
+func (noMetrics) setGauge(name string, value float64)          {}
+
+// statsdMetrics sends StatsD lines over UDP. With tags on it uses the
+// DogStatsD extension and puts the route and status in tags rather than in
+// the metric name
+type statsdMetrics struct {
+	conn   net.Conn
+	prefix string
+	tags   bool
+}
+
+func newStatsdMetrics(addr, prefix string, tags bool) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{conn: conn, prefix: prefix, tags: tags}, nil
+}
+
+// send is fire and forget, a metric lost because no agent is listening
+// isn't worth slowing a request down for
+func (s *statsdMetrics) send(line string) {
+	s.conn.Write([]byte(s.prefix + line))
+}
+
+func (s *statsdMetrics) incrRequest(route string, status int) {
+	class := strconv.Itoa(status/100) + "xx"
+	if s.tags {
+		s.send("requests:1|c|#route:" + route + ",status:" + class)
+		return
+	}
+	s.send("requests." + statsdName(route) + "." + class + ":1|c")
+}
+
+func (s *statsdMetrics) observeLatency(route string, d time.Duration) {
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	if s.tags {
+		s.send("request_duration:" + ms + "|ms|#route:" + route)
+		return
+	}
+	s.send("request_duration." + statsdName(route) + ":" + ms + "|ms")
+}
+
+func (s *statsdMetrics) setGauge(name string, value float64) {
+	s.send(name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|g")
+}
+
+// statsdName makes a route pattern fit in a dotted metric name, /readyz
+// is readyz and / is root
+func statsdName(route string) string {
+	name := strings.Trim(route, "/")
+	if name == "" {
+		return "root"
+	}
+	return strings.NewReplacer("/", "_", ".", "_", ":", "_", "|", "_", "@", "_").Replace(name)
+}
+
+// newMetricsBackend makes the -metrics-backend
+func newMetricsBackend(kind, addr, prefix string) (metricsBackend, error) {
+	switch kind {
+	case "statsd":
+		return newStatsdMetrics(addr, prefix, false)
+	case "dogstatsd":
+		return newStatsdMetrics(addr, prefix, true)
+	default:
+		return noMetrics{}, nil
+	}
+}
+
+// reportGauges sends the current gauges every tick until stop is closed
+func reportGauges(backend metricsBackend, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		backend.setGauge("requests_in_flight", float64(atomic.LoadInt64(&inFlight)))
+		backend.setGauge("goroutines", float64(runtime.NumGoroutine()))
+		if !noRedis {
+			backend.setGauge("redis_connected", float64(atomic.LoadInt32(&redisConnected)))
+		}
+	}
+}
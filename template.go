@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// staticFile is the path of name in -static-dir
+func staticFile(name string) string {
+	return filepath.Join(staticDir, name)
+}
+
+// checkStaticDir makes sure dir is a directory we can list, a missing
+// volume would otherwise only show up as 404s and an empty page
+func checkStaticDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err := f.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s is empty", dir)
+		}
+		return fmt.Errorf("could not read %s: %v", dir, err)
+	}
+	return nil
+}
+
+// templatePath is the home page template in -static-dir
+func templatePath() string {
+	return staticFile("index.html")
+}
+
+// placeholders the handler knows how to fill in
+var templatePlaceholders = map[string]bool{
+	"BASE":   true,
+	"LANG":   true,
+	"LEAD":   true,
+	"TITLE":  true,
+	"VISITS": true,
+}
+
+// fallbackPage is served while no template has parsed, which only happens
+// when it was broken at startup and -template-fallback is set. The first
+// one that parses, after an edit or SIGHUP, takes over from it
+const fallbackPage = `<!doctype html>
+<html lang="{{LANG}}">
+  <head>
+    <meta charset="utf-8">
+    <title>{{TITLE}}</title>
+  </head>
+  <body>
+    <h1>You are here!</h1>
+    <p>{{LEAD}}</p>
+  </body>
+</html>
+`
+
+// the last template that parsed, with the file's modification time and size
+// when it was read
+type loadedTemplate struct {
+	content string
+	modTime time.Time
+	size    int64
+}
+
+var (
+	// holds a *loadedTemplate, swapped whole so a reader never sees half
+	// of a reload
+	currentTemplate atomic.Value
+	// one reload at a time, and the modification time of the last file
+	// that was rejected so it is only logged once
+	templateMu       sync.Mutex
+	rejectedTemplate time.Time
+)
+
+// readTemplate reads and parses the template without installing it
+func readTemplate() (*loadedTemplate, error) {
+	f, err := os.Open(templatePath())
+	if err != nil {
+		return nil, fmt.Errorf("could not read template: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("could not read template: %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read template: %v", err)
+	}
+	if err := parseTemplate(string(content)); err != nil {
+		return nil, err
+	}
+	return &loadedTemplate{content: string(content), modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// checkTemplate reloads the home page template, at startup and on SIGHUP.
+// If it doesn't parse the one already loaded is kept
+func checkTemplate() error {
+	templateMu.Lock()
+	defer templateMu.Unlock()
+	t, err := readTemplate()
+	if err != nil {
+		return err
+	}
+	currentTemplate.Store(t)
+	return nil
+}
+
+// parseTemplate checks every {{...}} is closed and known, and that the
+// lead is there. Errors say which line is at fault
+func parseTemplate(content string) error {
+	lead := false
+	for i, line := range strings.Split(content, "\n") {
+		rest := line
+		for {
+			open := strings.Index(rest, "{{")
+			if open < 0 {
+				break
+			}
+			end := strings.Index(rest[open:], "}}")
+			if end < 0 {
+				return fmt.Errorf("%s:%d: unclosed {{", templatePath(), i+1)
+			}
+			name := rest[open+2 : open+end]
+			if !templatePlaceholders[name] {
+				return fmt.Errorf("%s:%d: unknown placeholder {{%s}}", templatePath(), i+1, name)
+			}
+			if name == "LEAD" {
+				lead = true
+			}
+			rest = rest[open+end+2:]
+		}
+	}
+	if !lead {
+		return fmt.Errorf("%s: no {{LEAD}} placeholder", templatePath())
+	}
+	return nil
+}
+
+// templateContent is the home page template, or the built-in page when the
+// template couldn't be used at startup. An edited template is picked up on
+// the next request, as long as it parses
+func templateContent() string {
+	t, _ := currentTemplate.Load().(*loadedTemplate)
+	info, err := os.Stat(templatePath())
+	if err != nil || (t != nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size) {
+		return t.contentOrFallback()
+	}
+
+	templateMu.Lock()
+	defer templateMu.Unlock()
+	// someone else may have reloaded it while we waited
+	if t, _ = currentTemplate.Load().(*loadedTemplate); t != nil && info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return t.content
+	}
+	if info.ModTime().Equal(rejectedTemplate) {
+		return t.contentOrFallback()
+	}
+	fresh, err := readTemplate()
+	if err != nil {
+		rejectedTemplate = info.ModTime()
+		requestLogger(context.Background()).Printf("Keeping the previous template, the edited one can't be used: %v\n", err)
+		return t.contentOrFallback()
+	}
+	currentTemplate.Store(fresh)
+	return fresh.content
+}
+
+func (t *loadedTemplate) contentOrFallback() string {
+	if t == nil {
+		return fallbackPage
+	}
+	return t.content
+}
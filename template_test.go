@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFallbackPageUntilTemplateFixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helloworld-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := filepath.Join(dir, "index.html")
+	if err := ioutil.WriteFile(index, []byte("<h1>{{TITLE}}</h1>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startTestServer(t, "-static-dir", dir, "-template-fallback")
+	defer s.Close()
+	if _, body := s.get(t, "/"); !strings.Contains(body, "<h1>You are here!</h1>") {
+		t.Fatalf("the broken template didn't get the built-in page:\n%s", body)
+	}
+
+	good, err := ioutil.ReadFile(filepath.Join("static", "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(index, good, 0644); err != nil {
+		t.Fatal(err)
+	}
+	handleReload(log.New(ioutil.Discard, "", 0))
+	if loaded, _ := currentTemplate.Load().(*loadedTemplate); loaded == nil {
+		t.Fatal("SIGHUP didn't load the fixed template")
+	}
+	res, body := s.get(t, "/")
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `<h1 class="cover-heading">`) {
+		t.Errorf("still not serving the fixed template after SIGHUP, got %d:\n%s", res.StatusCode, body)
+	}
+}
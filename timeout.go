@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestBudget is how long a request may take: the client's
+// X-Request-Timeout, in seconds or as a duration like "500ms", capped at
+// max, otherwise def. The header is ignored when max is 0. 0 means no
+// deadline
+func requestBudget(r *http.Request, def, max time.Duration) time.Duration {
+	header := strings.TrimSpace(r.Header.Get("X-Request-Timeout"))
+	if max == 0 || header == "" {
+		return def
+	}
+	asked, err := time.ParseDuration(header)
+	if err != nil {
+		secs, err := strconv.ParseFloat(header, 64)
+		if err != nil {
+			return def
+		}
+		asked = time.Duration(secs * float64(time.Second))
+	}
+	if asked <= 0 {
+		return def
+	}
+	if asked > max {
+		return max
+	}
+	return asked
+}
+
+// requestTimeout puts a deadline on the request context from requestBudget
+// and says what it was in the X-Request-Timeout response header, in
+// seconds. Anything that hasn't answered by then gets a 503
+func requestTimeout(def, max time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if def == 0 && max == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			budget := requestBudget(r, def, max)
+			if budget == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), budget)
+			defer cancel()
+
+			w.Header().Set("X-Request-Timeout", strconv.FormatFloat(budget.Seconds(), 'f', -1, 64))
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rw, r.WithContext(ctx))
+			if !rw.wroteHeader && ctx.Err() == context.DeadlineExceeded {
+				writeJSONError(rw, r, http.StatusServiceUnavailable, "request timed out")
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// when the process started, near enough
+var startTime = time.Now()
+
+// uptime says when the process started and how long ago that was
+func uptime(w http.ResponseWriter, r *http.Request) {
+	up := time.Since(startTime)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Started       string  `json:"started"`
+		Uptime        string  `json:"uptime"`
+		UptimeSeconds float64 `json:"uptime_seconds"`
+	}{
+		Started:       startTime.UTC().Format(time.RFC3339),
+		Uptime:        up.Round(time.Second).String(),
+		UptimeSeconds: up.Seconds(),
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+)
+
+var (
+	// home page views served by this process, what the page shows when
+	// the shared count in Redis can't be had
+	localVisits int64
+	// 1 while the count shown comes from Redis
+	sharedVisits int32
+)
+
+func init() {
+	expvar.Publish("visits", expvar.Func(func() interface{} {
+		source := "memory, this instance only"
+		if atomic.LoadInt32(&sharedVisits) == 1 {
+			source = "redis"
+		}
+		return map[string]interface{}{
+			"local":  atomic.LoadInt64(&localVisits),
+			"source": source,
+		}
+	}))
+}
+
+// countVisit counts a home page view and returns the count to show. That
+// is the INCR of the shared count in Redis when it is connected, otherwise
+// or if the INCR fails, this process's own count. It never fails
+func countVisit(ctx context.Context, connected bool) int64 {
+	local := atomic.AddInt64(&localVisits, 1)
+	client := currentRedis()
+	if !connected || client == nil {
+		if atomic.CompareAndSwapInt32(&sharedVisits, 1, 0) {
+			redisFallbacks.add("visits", "disconnected")
+		}
+		return local
+	}
+	var shared int64
+	err := withContext(ctx, func() error {
+		var err error
+		shared, err = client.Incr(redisKey("visits")).Result()
+		return err
+	})
+	if err != nil {
+		requestLogger(ctx).Printf("Could not count the visit in Redis, showing this instance's count: %v\n", err)
+		if atomic.CompareAndSwapInt32(&sharedVisits, 1, 0) {
+			redisFallbacks.add("visits", "error")
+		}
+		return local
+	}
+	atomic.StoreInt32(&sharedVisits, 1)
+	return shared
+}
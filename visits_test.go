@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fallbackCount is what redis_fallbacks says for feature and reason
+func fallbackCount(feature, reason string) int64 {
+	counts, ok := redisFallbacks.m.Get(feature).(*expvar.Map)
+	if !ok {
+		return 0
+	}
+	n, ok := counts.Get(reason).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return n.Value()
+}
+
+// Redis answering PING but failing INCR still gets the page, with this
+// instance's count
+func TestVisitsWithFailingRedis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helloworld-static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("{{LEAD}} <p>{{VISITS}}</p>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := startFakeRedis(t, 0)
+	defer fake.close()
+	fake.hangUpOn = "INCR"
+	s := startTestServer(t, "-no-redis=false", "-redis", fake.addr(), "-static-dir", dir)
+	defer s.Close()
+
+	// the count was coming from Redis until now
+	atomic.StoreInt32(&sharedVisits, 1)
+	fallbacks := fallbackCount("visits", "error")
+	for i := 0; i < 3; i++ {
+		res, body := s.get(t, "/")
+		local := atomic.LoadInt64(&localVisits)
+		if want := fmt.Sprintf(" <p>%d</p>", local); res.StatusCode != http.StatusOK || !strings.HasSuffix(body, want+"\n") {
+			t.Errorf("view %d: got %d %q, want 200 %q", i, res.StatusCode, body, want)
+		}
+	}
+
+	if n := fake.received("INCR"); n < 3 {
+		t.Errorf("INCR was sent %d times, want every view to try it", n)
+	}
+	if got := fallbackCount("visits", "error") - fallbacks; got != 1 {
+		t.Errorf("redis_fallbacks visits error went up by %d, want 1 for the switch", got)
+	}
+	if got := expvar.Get("visits").String(); !strings.Contains(got, "memory, this instance only") {
+		t.Errorf("the visits var is %s, want the count from memory", got)
+	}
+	if logs := s.logs.String(); !strings.Contains(logs, "Could not count the visit in Redis") {
+		t.Errorf("the failed INCR wasn't logged:\n%s", logs)
+	}
+}